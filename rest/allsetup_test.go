@@ -9,6 +9,8 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,6 +27,13 @@ var server = httptest.NewServer(tmux)
 
 var users []User
 
+// Requests received by the missing handler
+var missingHits int64
+
+// Requests received by the hot handler, and the last Cache-Control header
+var hotHits int64
+var hotCacheControl atomic.Value
+
 var userList = []string{
 	"Hernan", "Mariana", "Matilda", "Juan", "Pedro", "John", "Axel", "Mateo",
 }
@@ -58,14 +67,96 @@ func setup() {
 	tmux.HandleFunc("/cache/lastmodified/user", usersLastModified)
 	tmux.HandleFunc("/slow/cache/user", slowUsersCache)
 	tmux.HandleFunc("/slow/user", slowUsers)
+	tmux.HandleFunc("/heuristic/user", usersHeuristic)
+	tmux.HandleFunc("/hot/user", hotUsers)
 
 	//One user
 	tmux.HandleFunc("/user/", oneUser)
 
+	//Not found
+	tmux.HandleFunc("/missing/", missing)
+
+	//Search, with the query in the body
+	tmux.HandleFunc("/search/user", searchUsers)
+
 	//Header
 	tmux.HandleFunc("/header", withHeader)
 }
 
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	f        func()
+	active   bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.Lock()
+	defer c.Unlock()
+
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+// Advance moves the clock forward, firing every timer that is due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+
+	c.now = c.now.Add(d)
+
+	var due []func()
+	for _, t := range c.timers {
+		if t.active && !t.deadline.After(c.now) {
+			t.active = false
+			due = append(due, t.f)
+		}
+	}
+
+	c.Unlock()
+
+	for _, f := range due {
+		f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+
+	active := t.active
+	t.active = true
+	t.deadline = t.clock.now.Add(d)
+	return active
+}
+
 func withHeader(writer http.ResponseWriter, req *http.Request) {
 
 	if req.Method == http.MethodGet {
@@ -78,6 +169,50 @@ func withHeader(writer http.ResponseWriter, req *http.Request) {
 	return
 }
 
+func missing(writer http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&missingHits, 1)
+	writer.WriteHeader(http.StatusNotFound)
+}
+
+func hotUsers(writer http.ResponseWriter, req *http.Request) {
+
+	atomic.AddInt64(&hotHits, 1)
+	hotCacheControl.Store(req.Header.Get("Cache-Control"))
+
+	b, _ := json.Marshal(users)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=10")
+	writer.Write(b)
+}
+
+func searchUsers(writer http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost && req.Method != MethodQuery {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := new(User)
+	if err := json.NewDecoder(req.Body).Decode(q); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var found []User
+	for _, u := range users {
+		if u.Name == q.Name {
+			found = append(found, u)
+		}
+	}
+
+	b, _ := json.Marshal(found)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "max-age=60")
+	writer.Write(b)
+}
+
 func slowUsersCache(writer http.ResponseWriter, req *http.Request) {
 	time.Sleep(30 * time.Millisecond)
 	usersCache(writer, req)
@@ -160,6 +295,19 @@ func usersLastModified(writer http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func usersHeuristic(writer http.ResponseWriter, req *http.Request) {
+
+	// Get
+	if req.Method == http.MethodGet {
+
+		b, _ := json.Marshal(users)
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Last-Modified", time.Now().Add(-10*time.Hour).UTC().Format(httpDateFormat))
+		writer.Write(b)
+	}
+}
+
 func usersXML(writer http.ResponseWriter, req *http.Request) {
 
 	// Get
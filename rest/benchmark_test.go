@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"testing"
 )
 
@@ -59,3 +60,60 @@ func BenchmarkSlowConcurrentGet(b *testing.B) {
 	}
 
 }
+
+// Cache benchmarks run in parallel, without going through the network.
+// Compare throughput across GOMAXPROCS with:
+//
+//	go test -run none -bench ResourceCache -cpu 1,2,4,8
+func newBenchResponse() *Response {
+	return &Response{
+		Response: &http.Response{Header: make(http.Header)},
+		byteBody: make([]byte, 1024),
+	}
+}
+
+func BenchmarkResourceCacheGet(b *testing.B) {
+
+	const keys = 1024
+
+	for i := 0; i < keys; i++ {
+		resourceCache.setNX("/bench/get/"+strconv.Itoa(i), newBenchResponse())
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			resourceCache.get("/bench/get/" + strconv.Itoa(i%keys))
+		}
+	})
+
+}
+
+func BenchmarkResourceCacheSetNX(b *testing.B) {
+
+	var n int64
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := "/bench/setnx/" + strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+			resourceCache.setNX(key, newBenchResponse())
+		}
+	})
+
+}
+
+func BenchmarkResourceCacheMixed(b *testing.B) {
+
+	const keys = 4096
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := "/bench/mixed/" + strconv.Itoa(i%keys)
+			if resourceCache.get(key) == nil {
+				resourceCache.setNX(key, newBenchResponse())
+			}
+		}
+	})
+
+}
@@ -0,0 +1,198 @@
+package rest
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Cache is where a RequestBuilder stores its Responses.
+// It is implemented by ResourceCache (in memory), DiskCache, and TieredCache
+// which combines both.
+type Cache interface {
+
+	// Close releases the resources of the cache. A closed cache stores nothing.
+	Close() error
+
+	get(key string) *Response
+	setNX(key string, value *Response)
+	set(key string, value *Response)
+	now() time.Time
+	emit(ev CacheEvent)
+
+	// From now on, expired Responses are kept until evicted by size, so
+	// offline RequestBuilders can serve them
+	keepExpired()
+}
+
+// TieredCache is a two levels Cache. Responses are looked up in L1 first,
+// and then in L2, being copied to L1 when found there.
+// Typically L1 is a ResourceCache, and L2 a DiskCache, so restarts begin warm.
+type TieredCache struct {
+	L1 Cache
+	L2 Cache
+}
+
+// Close closes both levels
+func (tc *TieredCache) Close() error {
+
+	err1 := tc.L1.Close()
+	err2 := tc.L2.Close()
+
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+func (tc *TieredCache) get(key string) *Response {
+
+	if resp := tc.L1.get(key); resp != nil {
+		return resp
+	}
+
+	resp := tc.L2.get(key)
+	if resp != nil {
+		tc.L1.setNX(key, resp.cacheCopy())
+	}
+
+	return resp
+}
+
+// Each level gets its own Response, as caches keep their bookkeeping in it
+func (tc *TieredCache) setNX(key string, value *Response) {
+	tc.L1.setNX(key, value)
+	tc.L2.setNX(key, value.cacheCopy())
+}
+
+func (tc *TieredCache) set(key string, value *Response) {
+	tc.L1.set(key, value)
+	tc.L2.set(key, value.cacheCopy())
+}
+
+func (tc *TieredCache) keepExpired() {
+	tc.L1.keepExpired()
+	tc.L2.keepExpired()
+}
+
+func (tc *TieredCache) now() time.Time {
+	return tc.L1.now()
+}
+
+// Events of each level are sent by its own hook. Revalidations, which are
+// not from any level, go to L1
+func (tc *TieredCache) emit(ev CacheEvent) {
+	tc.L1.emit(ev)
+}
+
+// cacheEntry is the serializable form of a cached Response.
+// Just what is needed to rebuild it: status, headers, body and validators.
+type cacheEntry struct {
+	Key          string
+	Method       string
+	StatusCode   int
+	Status       string
+	Proto        string
+	Header       http.Header
+	Body         []byte     `json:",omitempty"`
+	TTL          *time.Time `json:",omitempty"`
+	LastModified *time.Time `json:",omitempty"`
+	ETag         string     `json:",omitempty"`
+	Revalidate   bool       `json:",omitempty"`
+	FetchedAt    *time.Time `json:",omitempty"`
+}
+
+// Fails if the body was compressed, and it can't be decompressed
+func newCacheEntry(key string, resp *Response) (*cacheEntry, error) {
+
+	body := resp.byteBody
+
+	// Not memoized, as resp may be the one held by a cache
+	if resp.compressed {
+		var err error
+		if body, err = decompressBody(resp.byteBody); err != nil {
+			return nil, err
+		}
+	}
+
+	entry := &cacheEntry{
+		Key:          key,
+		Method:       http.MethodGet,
+		StatusCode:   resp.StatusCode,
+		Status:       resp.Status,
+		Proto:        resp.Proto,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		TTL:          resp.ttl,
+		LastModified: resp.lastModified,
+		ETag:         resp.etag,
+		Revalidate:   resp.revalidate,
+	}
+
+	if !resp.fetchedAt.IsZero() {
+		fetchedAt := resp.fetchedAt
+		entry.FetchedAt = &fetchedAt
+	}
+
+	if resp.Request != nil {
+		entry.Method = resp.Request.Method
+	}
+
+	return entry, nil
+}
+
+func (entry *cacheEntry) response() *Response {
+
+	req := &http.Request{
+		Method: entry.Method,
+		Header: make(http.Header),
+	}
+
+	if u, err := url.Parse(entry.Key); err == nil {
+		req.URL = u
+		req.Host = u.Host
+	}
+
+	major, minor, _ := http.ParseHTTPVersion(entry.Proto)
+
+	resp := &Response{
+		Response: &http.Response{
+			Status:     entry.Status,
+			StatusCode: entry.StatusCode,
+			Proto:      entry.Proto,
+			ProtoMajor: major,
+			ProtoMinor: minor,
+			Header:     entry.Header.Clone(),
+			Body:       http.NoBody,
+			Request:    req,
+		},
+		byteBody:     entry.Body,
+		ttl:          entry.TTL,
+		lastModified: entry.LastModified,
+		etag:         entry.ETag,
+		revalidate:   entry.Revalidate,
+	}
+
+	if entry.FetchedAt != nil {
+		resp.fetchedAt = *entry.FetchedAt
+	}
+
+	return resp
+}
+
+// A copy of a Response, without the bookkeeping of the cache holding it
+// (LRU element, TTL node, size and hits), so it can be stored in another one.
+// The http.Response and the body are shared, as caches don't modify them.
+func (r *Response) cacheCopy() *Response {
+	return &Response{
+		Response:     r.Response,
+		byteBody:     r.byteBody,
+		compressed:   r.compressed,
+		ttl:          r.ttl,
+		lastModified: r.lastModified,
+		etag:         r.etag,
+		revalidate:   r.revalidate,
+		fetchedAt:    r.fetchedAt,
+	}
+}
@@ -0,0 +1,138 @@
+package rest
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl are the cache directives of a single request. They are
+// honored by the local cache, and sent upstream in the Cache-Control header.
+//
+// Stale Responses are only found in caches that keep them, see
+// ResourceCache.KeepStale.
+type CacheControl struct {
+
+	// Never serve from cache. Cached Responses with an etag or last modified
+	// date are revalidated, the rest are fetched again
+	NoCache bool
+
+	// Serve from cache, or a 504 (Gateway Timeout) Response if there's none
+	// usable. The network is never used
+	OnlyIfCached bool
+
+	// Expired Responses are served up to this long after their TTL
+	MaxStale time.Duration
+
+	// Responses are served only if they are fresh for at least this long
+	MinFresh time.Duration
+}
+
+// Request is a single request to be sent with Do, for the options that
+// apply to just one request.
+type Request struct {
+	Method string
+
+	// URL, to be prefixed with the RequestBuilder BaseURL
+	URL string
+
+	// Body could be any of the form: string, []byte, struct & map.
+	Body interface{}
+
+	// Cache directives. Nil means the cache is used as usual
+	CacheControl *CacheControl
+}
+
+// Do sends a Request, for the cases where the verb methods are not enough.
+// As them, it is cached according to the RequestBuilder.
+func (rb *RequestBuilder) Do(req *Request) *Response {
+
+	if !rb.acquire() {
+		return &Response{Err: ErrBuilderClosed}
+	}
+
+	defer rb.inFlight.Done()
+
+	return rb.send(req.Method, rb.BaseURL+req.URL, req.Body, req.CacheControl, false)
+}
+
+func (cc *CacheControl) noCache() bool {
+	return cc != nil && cc.NoCache
+}
+
+func (cc *CacheControl) onlyIfCached() bool {
+	return cc != nil && cc.OnlyIfCached
+}
+
+// Whether a cached Response can be served, instead of going to the network.
+// Without directives, it must be fresh and not need a revalidation.
+func (cc *CacheControl) usable(resp *Response, now time.Time) bool {
+
+	if cc.noCache() {
+		return false
+	}
+
+	var maxStale, minFresh time.Duration
+	if cc != nil {
+		maxStale, minFresh = cc.MaxStale, cc.MinFresh
+	}
+
+	// Responses to be revalidated have no freshness. They are stale since fetched
+	if resp.revalidate || resp.ttl == nil {
+		return maxStale > 0 && !resp.fetchedAt.IsZero() && now.Sub(resp.fetchedAt) <= maxStale
+	}
+
+	if left := resp.ttl.Sub(now); left > 0 {
+		return left >= minFresh
+	}
+
+	return now.Sub(*resp.ttl) <= maxStale && maxStale > 0
+}
+
+// The outgoing Cache-Control header. Empty if there are no directives
+func (cc *CacheControl) header() string {
+
+	if cc == nil {
+		return ""
+	}
+
+	var directives []string
+
+	if cc.NoCache {
+		directives = append(directives, "no-cache")
+	}
+
+	if cc.OnlyIfCached {
+		directives = append(directives, "only-if-cached")
+	}
+
+	if cc.MaxStale > 0 {
+		directives = append(directives, "max-stale="+strconv.Itoa(int(cc.MaxStale/time.Second)))
+	}
+
+	if cc.MinFresh > 0 {
+		directives = append(directives, "min-fresh="+strconv.Itoa(int(cc.MinFresh/time.Second)))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// The Response to an only-if-cached request, with nothing usable in cache
+func gatewayTimeout(verb string, reqURL string) *Response {
+
+	req, _ := http.NewRequest(verb, reqURL, nil)
+
+	return &Response{
+		Response: &http.Response{
+			Status:     "504 Gateway Timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		},
+	}
+}
@@ -0,0 +1,112 @@
+package rest
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheControlOnlyIfCached(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+	onlyIfCached := &Request{Method: http.MethodGet, URL: "/hot/user", CacheControl: &CacheControl{OnlyIfCached: true}}
+
+	hits := atomic.LoadInt64(&hotHits)
+
+	if r := builder.Do(onlyIfCached); r.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("Status != Gateway Timeout (504)")
+	}
+
+	if atomic.LoadInt64(&hotHits) != hits {
+		t.Fatal("Network should not be used")
+	}
+
+	builder.Get("/hot/user")
+
+	if r := builder.Do(onlyIfCached); r.StatusCode != http.StatusOK || !r.CacheHit() {
+		t.Fatal("Response should be served from cache")
+	}
+
+	if hotCacheControl.Load().(string) != "" {
+		t.Fatal("Cache-Control should not be sent if not requested")
+	}
+
+}
+
+func TestCacheControlFreshness(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock, KeepStale: time.Minute}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	hits := atomic.LoadInt64(&hotHits)
+
+	builder.Get("/hot/user")
+
+	// 2 seconds left
+	clock.Advance(8 * time.Second)
+
+	if r := builder.Do(&Request{Method: http.MethodGet, URL: "/hot/user", CacheControl: &CacheControl{MinFresh: 5 * time.Second}}); r.CacheHit() {
+		t.Fatal("Response is not fresh enough, should be fetched")
+	}
+
+	if atomic.LoadInt64(&hotHits)-hits != 2 {
+		t.Fatal("Upstream should be hit again")
+	}
+
+	if hotCacheControl.Load().(string) != "min-fresh=5" {
+		t.Fatal("Cache-Control should be sent")
+	}
+
+	// 5 seconds stale
+	clock.Advance(15 * time.Second)
+
+	stale := &CacheControl{OnlyIfCached: true}
+	if r := builder.Do(&Request{Method: http.MethodGet, URL: "/hot/user", CacheControl: stale}); r.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("Stale Response should not be served without max-stale")
+	}
+
+	stale.MaxStale = 10 * time.Second
+	if r := builder.Do(&Request{Method: http.MethodGet, URL: "/hot/user", CacheControl: stale}); !r.CacheHit() {
+		t.Fatal("Stale Response should be served with max-stale")
+	}
+
+	// Without directives, a stale Response is fetched again
+	if builder.Get("/hot/user").CacheHit() {
+		t.Fatal("Stale Response should be fetched")
+	}
+
+}
+
+func TestCacheControlNoCache(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	builder.Get("/hot/user")
+
+	hits := atomic.LoadInt64(&hotHits)
+
+	r := builder.Do(&Request{Method: http.MethodGet, URL: "/hot/user", CacheControl: &CacheControl{NoCache: true}})
+	if r.StatusCode != http.StatusOK || r.CacheHit() {
+		t.Fatal("no-cache should not be served from cache")
+	}
+
+	if atomic.LoadInt64(&hotHits)-hits != 1 || hotCacheControl.Load().(string) != "no-cache" {
+		t.Fatal("no-cache should go to the upstream")
+	}
+
+	if !builder.Get("/hot/user").CacheHit() {
+		t.Fatal("Cache should hold the new Response")
+	}
+
+}
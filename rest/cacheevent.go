@@ -0,0 +1,54 @@
+package rest
+
+// CacheEventType is the kind of a CacheEvent
+type CacheEventType int
+
+const (
+	// CacheInsert is a Response stored in the cache
+	CacheInsert CacheEventType = iota
+
+	// CacheHit is a Response found in the cache
+	CacheHit
+
+	// CacheMiss is a Response not found in the cache
+	CacheMiss
+
+	// CacheRevalidate is a cached Response checked against the upstream,
+	// with its etag or last modified date
+	CacheRevalidate
+
+	// CacheExpire is a Response removed because its TTL was reached
+	CacheExpire
+
+	// CacheEvict is a Response removed, or not stored, for any other reason
+	CacheEvict
+)
+
+var cacheEventNames = [...]string{"insert", "hit", "miss", "revalidate", "expire", "evict"}
+
+func (t CacheEventType) String() string {
+
+	if t < 0 || int(t) >= len(cacheEventNames) {
+		return "unknown"
+	}
+
+	return cacheEventNames[t]
+}
+
+// CacheEvent is sent to the OnEvent hook of a cache, to observe how it
+// behaves. For instance, to tune its MaxSize or the TTL of a CachePolicy.
+type CacheEvent struct {
+	Type CacheEventType
+
+	// Cache key of the Response, usually its URL
+	Key string
+
+	// Size accounted for the Response in the cache. Zero on a miss
+	Size int64
+
+	// Why it happened, for expire, evict and revalidate events:
+	//  expire:     "ttl" (by the TTL goroutine), "read" (found expired on a get)
+	//  evict:      "max size", "replaced", "too big", "write error"
+	//  revalidate: "not modified", "modified"
+	Reason string
+}
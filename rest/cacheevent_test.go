@@ -0,0 +1,120 @@
+package rest
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	sync.Mutex
+	events []CacheEvent
+}
+
+func (r *eventRecorder) record(ev CacheEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// The events of a key, as "type:reason"
+func (r *eventRecorder) of(key string) []string {
+	r.Lock()
+	defer r.Unlock()
+
+	var s []string
+	for _, ev := range r.events {
+		if ev.Key == key {
+			s = append(s, ev.Type.String()+":"+ev.Reason)
+		}
+	}
+
+	return s
+}
+
+func equalEvents(a []string, b ...string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCacheEvents(t *testing.T) {
+
+	clock := newFakeClock()
+	rec := new(eventRecorder)
+
+	cache := &ResourceCache{Clock: clock, MaxSize: 4 * KB, OnEvent: rec.record}
+	defer cache.Close()
+
+	resp := newBenchResponse()
+	ttl := clock.Now().Add(time.Minute)
+	resp.ttl = &ttl
+
+	cache.setNX("/events/ttl", resp)
+	cache.get("/events/ttl")
+	cache.get("/events/none")
+
+	clock.Advance(2 * time.Minute)
+	cache.expire(cache.shard("/events/ttl"), clock.Now())
+
+	if e := rec.of("/events/ttl"); !equalEvents(e, "insert:", "hit:", "expire:ttl") {
+		t.Fatal("Wrong events", e)
+	}
+
+	if e := rec.of("/events/none"); !equalEvents(e, "miss:") {
+		t.Fatal("Wrong events", e)
+	}
+
+	// Older Responses are evicted, as they don't fit
+	cache.setNX("/events/lru", newBenchResponse())
+	for i := 0; i < 4; i++ {
+		cache.setNX("/events/lru/"+string(rune('a'+i)), newBenchResponse())
+	}
+
+	if e := rec.of("/events/lru"); !equalEvents(e, "insert:", "evict:max size") {
+		t.Fatal("Wrong events", e)
+	}
+
+	big := newBenchResponse()
+	big.byteBody = make([]byte, 8*KB)
+	cache.setNX("/events/big", big)
+
+	if e := rec.of("/events/big"); !equalEvents(e, "evict:too big") {
+		t.Fatal("Wrong events", e)
+	}
+
+	for _, ev := range rec.events {
+		if ev.Type != CacheMiss && ev.Size <= 0 {
+			t.Fatal("Event without size", ev)
+		}
+	}
+
+}
+
+func TestCacheRevalidateEvents(t *testing.T) {
+
+	rec := new(eventRecorder)
+
+	cache := &ResourceCache{OnEvent: rec.record}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	builder.Get("/cache/etag/user")
+	builder.Get("/cache/etag/user")
+
+	e := rec.of(server.URL + "/cache/etag/user")
+	if !equalEvents(e, "miss:", "insert:", "hit:", "revalidate:not modified") {
+		t.Fatal("Wrong events", e)
+	}
+
+}
@@ -0,0 +1,120 @@
+package rest
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// CachePolicy overrides how Responses are cached, for APIs whose cache headers
+// are missing or not the ones you would like.
+//
+// Policies apply to read verbs only, as the cache does.
+type CachePolicy struct {
+
+	// Cache every Response for this TTL, whatever TTL its headers say. Not
+	// the ones saying no-cache or no-store, unless IgnoreNoCache. Only for
+	// statuses cacheable by default (200, 203, 204, 206, 300, 301, 308, 404,
+	// 405, 410, 414 and 501). Others keep the TTL of their headers
+	ForceTTL time.Duration
+
+	// Clamp the TTL given by the server to this maximum
+	MaxTTL time.Duration
+
+	// Raise the TTL given by the server to this minimum
+	MinTTL time.Duration
+
+	// Cache even if the server says no-cache or no-store
+	IgnoreNoCache bool
+
+	// Give Responses without an explicit TTL, but with Last-Modified, a TTL of
+	// 10% of the time since they were modified, as RFC 7234 section 4.2.2
+	// suggests. Not for max-age=0 or a past Expires, which are explicit, nor
+	// for statuses not cacheable by default
+	HeuristicFreshness bool
+}
+
+// URLCachePolicy is a CachePolicy for the URLs whose path matches Pattern.
+// Patterns are the ones of path.Match, like "/items/*".
+type URLCachePolicy struct {
+	Pattern string
+	Policy  *CachePolicy
+}
+
+// The fraction of the time since Last-Modified used by HeuristicFreshness
+const heuristicFraction = 10
+
+// The first URLCachePolicy matching the URL path, or the builder CachePolicy.
+// Nil if none
+func (rb *RequestBuilder) getCachePolicy(reqURL string) *CachePolicy {
+
+	if len(rb.CachePolicies) > 0 {
+		if u, err := url.Parse(reqURL); err == nil {
+			for _, p := range rb.CachePolicies {
+				if ok, _ := path.Match(p.Pattern, u.Path); ok {
+					return p.Policy
+				}
+			}
+		}
+	}
+
+	return rb.CachePolicy
+}
+
+func (policy *CachePolicy) ignoreNoCache() bool {
+	return policy != nil && policy.IgnoreNoCache
+}
+
+// Clamps ttl between MinTTL and MaxTTL
+func (policy *CachePolicy) clamp(ttl time.Duration) time.Duration {
+
+	if policy == nil {
+		return ttl
+	}
+
+	if policy.MinTTL > 0 && ttl < policy.MinTTL {
+		ttl = policy.MinTTL
+	}
+
+	if policy.MaxTTL > 0 && ttl > policy.MaxTTL {
+		ttl = policy.MaxTTL
+	}
+
+	return ttl
+}
+
+// Heuristic TTL from Last-Modified, relative to Date, or now if there's no Date
+func heuristicTTL(resp *Response, now time.Time) time.Duration {
+
+	lastModified, err := time.Parse(httpDateFormat, resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+
+	date, err := time.Parse(httpDateFormat, resp.Header.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	return date.Sub(lastModified) / heuristicFraction
+}
+
+// Checks if the Cache-Control header has a directive, as "no-cache", without
+// caring about its value.
+func hasCacheDirective(cacheControl string, directive string) bool {
+
+	for _, d := range strings.Split(cacheControl, ",") {
+
+		d = strings.TrimSpace(d)
+		if i := strings.IndexByte(d, '='); i >= 0 {
+			d = d[:i]
+		}
+
+		if strings.EqualFold(d, directive) {
+			return true
+		}
+	}
+
+	return false
+}
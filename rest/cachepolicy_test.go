@@ -0,0 +1,207 @@
+package rest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCachePolicyForceTTL(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{
+		BaseURL:     server.URL,
+		Cache:       cache,
+		CachePolicy: &CachePolicy{ForceTTL: time.Minute, IgnoreNoCache: true},
+	}
+
+	builder.Get("/user")
+
+	if !builder.Get("/user").CacheHit() {
+		t.Fatal("Response should be cached with ForceTTL")
+	}
+
+	noPolicy := RequestBuilder{BaseURL: server.URL, Cache: cache}
+	noPolicy.Get("/xml/user")
+
+	if noPolicy.Get("/xml/user").CacheHit() {
+		t.Fatal("no-cache Response should not be cached without policy")
+	}
+
+}
+
+func TestCachePolicyByPattern(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{
+		BaseURL: server.URL,
+		Cache:   cache,
+		CachePolicies: []URLCachePolicy{
+			{Pattern: "/user/*", Policy: &CachePolicy{ForceTTL: time.Minute, IgnoreNoCache: true}},
+		},
+	}
+
+	builder.Get("/user/1")
+	builder.Get("/user")
+
+	if !builder.Get("/user/1").CacheHit() {
+		t.Fatal("Response matching the pattern should be cached")
+	}
+
+	if builder.Get("/user").CacheHit() {
+		t.Fatal("Response not matching the pattern should not be cached")
+	}
+
+}
+
+func TestCachePolicyClamp(t *testing.T) {
+
+	now := time.Now()
+
+	resp := &Response{Response: &http.Response{Header: make(http.Header)}}
+	resp.Header.Set("Cache-Control", "max-age=3600")
+
+	setTTL(resp, now, &CachePolicy{MaxTTL: time.Minute})
+	if !resp.ttl.Equal(now.Add(time.Minute)) {
+		t.Fatal("TTL should be clamped to MaxTTL")
+	}
+
+	resp.Header.Set("Cache-Control", "max-age=1")
+
+	setTTL(resp, now, &CachePolicy{MinTTL: time.Minute})
+	if !resp.ttl.Equal(now.Add(time.Minute)) {
+		t.Fatal("TTL should be raised to MinTTL")
+	}
+
+	resp.ttl = nil
+	resp.Header.Set("Cache-Control", "no-cache, max-age=60")
+
+	if setTTL(resp, now, nil) {
+		t.Fatal("no-cache Response should not get a TTL")
+	}
+
+	if !setTTL(resp, now, &CachePolicy{IgnoreNoCache: true}) || !resp.ttl.Equal(now.Add(time.Minute)) {
+		t.Fatal("no-cache should be ignored")
+	}
+
+}
+
+func TestCachePolicyHeuristicFreshness(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{
+		BaseURL:     server.URL,
+		Cache:       cache,
+		CachePolicy: &CachePolicy{HeuristicFreshness: true},
+	}
+
+	resp := builder.Get("/heuristic/user")
+
+	// 10% of 10 hours
+	if resp.ttl == nil || resp.ttl.Sub(time.Now()) < 50*time.Minute {
+		t.Fatal("TTL should be 10% of the time since Last-Modified")
+	}
+
+	if !builder.Get("/heuristic/user").CacheHit() {
+		t.Fatal("Response should be cached")
+	}
+
+}
+
+func TestCachePolicyHeuristicExplicitTTL(t *testing.T) {
+
+	now := time.Now()
+	policy := &CachePolicy{HeuristicFreshness: true}
+
+	resp := &Response{Response: &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}}
+	resp.Header.Set("Last-Modified", now.Add(-10*time.Hour).UTC().Format(httpDateFormat))
+	resp.Header.Set("Cache-Control", "max-age=0")
+
+	if setTTL(resp, now, policy) {
+		t.Fatal("max-age=0 should not get a heuristic TTL")
+	}
+
+	resp.Header.Del("Cache-Control")
+	resp.Header.Set("Expires", now.Add(-time.Hour).UTC().Format(httpDateFormat))
+
+	if setTTL(resp, now, policy) {
+		t.Fatal("Expires in the past should not get a heuristic TTL")
+	}
+
+	resp.Header.Set("Expires", "0")
+
+	if setTTL(resp, now, policy) {
+		t.Fatal("Invalid Expires should not get a heuristic TTL")
+	}
+
+	resp.Header.Del("Expires")
+
+	if !setTTL(resp, now, policy) {
+		t.Fatal("Response without an explicit TTL should get a heuristic TTL")
+	}
+
+}
+
+func TestCachePolicyStatusNotCacheable(t *testing.T) {
+
+	now := time.Now()
+
+	resp := &Response{Response: &http.Response{StatusCode: http.StatusInternalServerError, Header: make(http.Header)}}
+	resp.Header.Set("Last-Modified", now.Add(-10*time.Hour).UTC().Format(httpDateFormat))
+
+	if setTTL(resp, now, &CachePolicy{ForceTTL: time.Minute}) {
+		t.Fatal("500 should not get a forced TTL")
+	}
+
+	if setTTL(resp, now, &CachePolicy{HeuristicFreshness: true}) {
+		t.Fatal("500 should not get a heuristic TTL")
+	}
+
+	resp.Header.Set("Cache-Control", "max-age=60")
+
+	if !setTTL(resp, now, &CachePolicy{ForceTTL: time.Hour}) || !resp.ttl.Equal(now.Add(time.Minute)) {
+		t.Fatal("500 should keep the TTL of its headers")
+	}
+
+	resp.StatusCode = http.StatusNotFound
+	resp.Header.Del("Cache-Control")
+
+	if !setTTL(resp, now, &CachePolicy{ForceTTL: time.Minute}) {
+		t.Fatal("404 should get a forced TTL")
+	}
+
+}
+
+func TestCachePolicyForceTTLNoStore(t *testing.T) {
+
+	mockServer := NewMockServer(t)
+	mockServer.AddMockups(&Mock{
+		URL:          "http://mytest.com/private",
+		HTTPMethod:   http.MethodGet,
+		RespHTTPCode: http.StatusOK,
+		RespHeaders:  http.Header{"Cache-Control": {"private, no-store"}},
+		RespBody:     "secret",
+	})
+
+	builder := RequestBuilder{MockServer: mockServer, CachePolicy: &CachePolicy{ForceTTL: time.Minute}}
+
+	builder.Get("http://mytest.com/private")
+
+	if builder.Get("http://mytest.com/private").CacheHit() {
+		t.Fatal("no-store Response should not be cached with ForceTTL")
+	}
+
+	builder.CachePolicy.IgnoreNoCache = true
+	builder.Get("http://mytest.com/private")
+
+	if !builder.Get("http://mytest.com/private").CacheHit() {
+		t.Fatal("no-store Response should be cached with IgnoreNoCache")
+	}
+
+}
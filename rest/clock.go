@@ -0,0 +1,30 @@
+package rest
+
+import (
+	"time"
+)
+
+// Clock gives the time to the ResourceCache, and to the TTL computation of
+// Responses. Every time related decision of the cache goes through it, so
+// time can be controlled in tests instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock. *time.Timer satisfies it.
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// The Clock used by default, backed by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,41 @@
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// Compresses a body with gzip, favouring speed over ratio as it is done on
+// every cache insert. Returns nil if compression does not make it smaller.
+func compressBody(body []byte) []byte {
+
+	var buf bytes.Buffer
+
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if _, err := w.Write(body); err != nil {
+		return nil
+	}
+
+	if err := w.Close(); err != nil {
+		return nil
+	}
+
+	if buf.Len() >= len(body) {
+		return nil
+	}
+
+	// Copied, so the cache is not charged for the spare capacity of the buffer
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func decompressBody(body []byte) ([]byte, error) {
+
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
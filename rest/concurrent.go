@@ -41,6 +41,7 @@ type Concurrent struct {
 	list       list.List
 	wg         sync.WaitGroup
 	reqBuilder *RequestBuilder
+	closed     bool
 }
 
 // Get issues a GET HTTP verb to the specified URL, concurrently with any other
@@ -89,6 +90,19 @@ func (c *Concurrent) Put(url string, body interface{}) *FutureResponse {
 	return c.doRequest(http.MethodPut, url, body)
 }
 
+// Query issues a QUERY HTTP verb to the specified URL, concurrently with any other
+// concurrent requests that may be called.
+//
+// QUERY is used for "reading" a resource, when the query is too complex for
+// the URL, so it's sent in the body.
+// Client should expect a response status code of 200(OK), 404(Not Found),
+// or 400(Bad Request).
+//
+// Body could be any of the form: string, []byte, struct & map.
+func (c *Concurrent) Query(url string, body interface{}) *FutureResponse {
+	return c.doRequest(MethodQuery, url, body)
+}
+
 // Delete issues a DELETE HTTP verb to the specified URL, concurrently with any other
 // concurrent requests that may be called.
 //
@@ -126,7 +140,12 @@ func (c *Concurrent) doRequest(verb string, url string, reqBody interface{}) *Fu
 
 	future := func() {
 		defer c.wg.Done()
-		r := c.reqBuilder.doRequest(verb, url, reqBody)
+
+		r := &Response{Err: ErrBuilderClosed}
+		if !c.closed {
+			r = c.reqBuilder.sendRequest(verb, url, reqBody)
+		}
+
 		atomic.StorePointer(&fr.p, unsafe.Pointer(r))
 	}
 
@@ -0,0 +1,496 @@
+package rest
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskCache is a Cache that persists Responses in a directory, so they
+// survive restarts.
+//
+// Bodies are content-addressed: stored once under the sha256 of their bytes,
+// no matter how many keys share them. An index file keeps, for every key,
+// the status, headers, validators (etag, last modified, ttl) and the body
+// address. The cache is bounded by MaxSize, removing least recently used
+// Responses first.
+//
+// The index is written in the background, every FlushInterval if it changed,
+// and on Close. Responses stored since the last write are lost on a crash.
+//
+// A DiskCache is ready to use when declared with a Dir. The directory is
+// loaded on first use. It must be closed, to write the index and stop
+// writing it.
+type DiskCache struct {
+
+	// Directory where Responses are stored. Created if it does not exist
+	Dir string
+
+	// Maximum Byte Size to be hold in disk. Zero means MaxCacheSize
+	MaxSize ByteSize
+
+	// Clock used for TTL. Nil means the system clock
+	Clock Clock
+
+	// How long Responses are kept once expired, to be served stale to
+	// requests that allow it. Zero means they are removed when they expire.
+	// Once an Offline or StaleIfOffline RequestBuilder uses the cache, they
+	// are kept until evicted by size
+	KeepStale time.Duration
+
+	// Called on every cache event. It is called outside the cache lock,
+	// but synchronously, so it should be fast. Nil means no hook
+	OnEvent func(CacheEvent)
+
+	// How often the index is written, if it changed. Zero means every second
+	FlushInterval time.Duration
+
+	mtx       sync.Mutex
+	initOnce  sync.Once
+	index     map[string]*diskEntry
+	lruList   *list.List       // List for LRU, front is the most recent
+	bodies    map[string]int64 // Body address -> number of entries using it
+	size      int64
+	closed    bool
+	dirty     bool          // The index changed since it was written
+	saveMtx   sync.Mutex    // Serializes index writes
+	stopFlush chan struct{} // Closed on Close
+	offline   int32         // Expired Responses are kept. Use atomic
+	err       error         // Why Dir can't be used, so nothing is stored
+}
+
+type diskEntry struct {
+	cacheEntry
+	BodyHash    string
+	Size        int64
+	AccessedAt  time.Time
+	Hits        uint32 `json:"-"`
+	listElement *list.Element
+}
+
+const diskIndexFile = "index.json"
+
+// This will be executed only once per cache
+func (dc *DiskCache) init() {
+
+	dc.initOnce.Do(func() {
+
+		dc.index = make(map[string]*diskEntry)
+		dc.bodies = make(map[string]int64)
+		dc.lruList = list.New()
+
+		if dc.Clock == nil {
+			dc.Clock = systemClock{}
+		}
+
+		if err := os.MkdirAll(filepath.Join(dc.Dir, "bodies"), 0755); err != nil {
+			dc.err = err
+		}
+
+		dc.load()
+
+		interval := dc.FlushInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+
+		dc.stopFlush = make(chan struct{})
+		go dc.flushLoop(interval, dc.stopFlush)
+	})
+
+}
+
+// Rebuild the index, skipping expired entries and the ones without a body
+func (dc *DiskCache) load() {
+
+	b, err := ioutil.ReadFile(filepath.Join(dc.Dir, diskIndexFile))
+	if err != nil {
+		return
+	}
+
+	var entries []*diskEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return
+	}
+
+	// Oldest first, so the most recent ends up at the front
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].AccessedAt.Before(entries[j].AccessedAt)
+	})
+
+	now := dc.Clock.Now()
+
+	for _, e := range entries {
+
+		if dc.gone(e.TTL, now) {
+			continue
+		}
+
+		if _, err := os.Stat(dc.bodyPath(e.BodyHash)); err != nil {
+			continue
+		}
+
+		dc.add(e)
+	}
+
+	dc.removeOrphanBodies()
+	dc.evict()
+}
+
+// Bodies left by entries that are no longer in the index
+func (dc *DiskCache) removeOrphanBodies() {
+
+	dirs, _ := ioutil.ReadDir(filepath.Join(dc.Dir, "bodies"))
+
+	for _, d := range dirs {
+
+		files, _ := ioutil.ReadDir(filepath.Join(dc.Dir, "bodies", d.Name()))
+
+		for _, f := range files {
+			if dc.bodies[f.Name()] == 0 {
+				os.Remove(filepath.Join(dc.Dir, "bodies", d.Name(), f.Name()))
+			}
+		}
+	}
+
+}
+
+// Close saves the index. A closed cache stores nothing.
+// If Dir could not be created, that is the error.
+func (dc *DiskCache) Close() error {
+
+	dc.init()
+
+	dc.mtx.Lock()
+
+	if dc.closed {
+		dc.mtx.Unlock()
+		return nil
+	}
+
+	dc.closed = true
+	dc.dirty = true
+	close(dc.stopFlush)
+
+	dc.mtx.Unlock()
+
+	if dc.err != nil {
+		return dc.err
+	}
+
+	return dc.flush()
+}
+
+func (dc *DiskCache) flushLoop(interval time.Duration, stop chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			dc.flush()
+		}
+	}
+}
+
+func (dc *DiskCache) now() time.Time {
+	dc.init()
+	return dc.Clock.Now()
+}
+
+// Before init, so expired Responses are kept when the directory is loaded
+func (dc *DiskCache) keepExpired() {
+	atomic.StoreInt32(&dc.offline, 1)
+}
+
+// Whether a Response with this ttl is no longer kept
+func (dc *DiskCache) gone(ttl *time.Time, now time.Time) bool {
+	return ttl != nil && atomic.LoadInt32(&dc.offline) == 0 && ttl.Add(dc.KeepStale).Sub(now) <= 0
+}
+
+func (dc *DiskCache) maxSize() ByteSize {
+
+	if dc.MaxSize > 0 {
+		return dc.MaxSize
+	}
+
+	return MaxCacheSize
+}
+
+func (dc *DiskCache) bodyPath(hash string) string {
+	return filepath.Join(dc.Dir, "bodies", hash[:2], hash)
+}
+
+func (dc *DiskCache) get(key string) *Response {
+
+	dc.init()
+
+	dc.mtx.Lock()
+
+	e := dc.index[key]
+	if dc.closed || e == nil {
+		dc.mtx.Unlock()
+		dc.emit(CacheEvent{Type: CacheMiss, Key: key})
+		return nil
+	}
+
+	//If expired, remove it
+	if dc.gone(e.TTL, dc.Clock.Now()) {
+		dc.remove(e)
+		dc.dirty = true
+		dc.mtx.Unlock()
+		dc.emit(CacheEvent{Type: CacheExpire, Key: key, Size: e.Size, Reason: "read"})
+		dc.emit(CacheEvent{Type: CacheMiss, Key: key})
+		return nil
+	}
+
+	e.AccessedAt = dc.Clock.Now()
+	e.Hits++
+	dc.lruList.MoveToFront(e.listElement)
+
+	// So the LRU order survives restarts
+	dc.dirty = true
+
+	entry := e.cacheEntry
+	hits := e.Hits
+	path := dc.bodyPath(e.BodyHash)
+
+	dc.mtx.Unlock()
+
+	// Read outside the lock. If the body was removed meanwhile, it is a miss.
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		dc.emit(CacheEvent{Type: CacheMiss, Key: key})
+		return nil
+	}
+
+	dc.emit(CacheEvent{Type: CacheHit, Key: key, Size: e.Size})
+
+	entry.Body = body
+
+	resp := entry.response()
+	resp.hits = hits
+
+	return resp
+}
+
+// Set if key not exist
+func (dc *DiskCache) setNX(key string, value *Response) {
+	dc.store(key, value, false)
+}
+
+// Set, replacing the Response if key exists
+func (dc *DiskCache) set(key string, value *Response) {
+	dc.store(key, value, true)
+}
+
+func (dc *DiskCache) store(key string, value *Response, replace bool) {
+
+	dc.init()
+
+	entry, err := newCacheEntry(key, value)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(entry.Body)
+	hash := hex.EncodeToString(sum[:])
+
+	e := &diskEntry{
+		cacheEntry: *entry,
+		BodyHash:   hash,
+		Size:       int64(len(entry.Body)) + headerSize(entry.Header) + int64(len(key)),
+		AccessedAt: dc.Clock.Now(),
+	}
+	e.Body = nil
+
+	if ByteSize(e.Size) > dc.maxSize() {
+		dc.emit(CacheEvent{Type: CacheEvict, Key: key, Size: e.Size, Reason: "too big"})
+		return
+	}
+
+	if dc.err != nil {
+		dc.emit(CacheEvent{Type: CacheEvict, Key: key, Size: e.Size, Reason: "write error"})
+		return
+	}
+
+	dc.mtx.Lock()
+
+	if dc.closed || (dc.index[key] != nil && !replace) {
+		dc.mtx.Unlock()
+		return
+	}
+
+	// Content-addressed, so if the body is already there, there's nothing to
+	// write. It is referenced while written out of the lock, so it isn't
+	// removed meanwhile, and by the old entry it may replace
+	write := dc.bodies[hash] == 0
+	dc.bodies[hash]++
+
+	dc.mtx.Unlock()
+
+	if write {
+		if err := writeFileAtomic(dc.bodyPath(hash), entry.Body); err != nil {
+			dc.mtx.Lock()
+			dc.release(hash)
+			dc.mtx.Unlock()
+			dc.emit(CacheEvent{Type: CacheEvict, Key: key, Size: e.Size, Reason: "write error"})
+			return
+		}
+	}
+
+	// Emitted once the lock is released
+	var events []CacheEvent
+	defer func() { dc.emitAll(events) }()
+
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+
+	defer dc.release(hash)
+
+	if dc.closed || (dc.index[key] != nil && !replace) {
+		return
+	}
+
+	if old := dc.index[key]; old != nil {
+		dc.remove(old)
+		events = append(events, CacheEvent{Type: CacheEvict, Key: key, Size: old.Size, Reason: "replaced"})
+	}
+
+	dc.add(e)
+	events = append(events, CacheEvent{Type: CacheInsert, Key: key, Size: e.Size})
+
+	events = append(events, dc.evict()...)
+	dc.dirty = true
+}
+
+// Lock must be held
+func (dc *DiskCache) add(e *diskEntry) {
+	dc.index[e.Key] = e
+	dc.bodies[e.BodyHash]++
+	dc.size += e.Size
+	e.listElement = dc.lruList.PushFront(e)
+}
+
+// Lock must be held
+func (dc *DiskCache) remove(e *diskEntry) {
+
+	delete(dc.index, e.Key)
+	dc.lruList.Remove(e.listElement)
+	dc.size -= e.Size
+
+	dc.release(e.BodyHash)
+}
+
+// Drops a reference to a body, removing it if it was the last one.
+// Lock must be held
+func (dc *DiskCache) release(hash string) {
+	if dc.bodies[hash]--; dc.bodies[hash] <= 0 {
+		delete(dc.bodies, hash)
+		os.Remove(dc.bodyPath(hash))
+	}
+}
+
+// Lock must be held. Returns the evict events, to be emitted once it is released
+func (dc *DiskCache) evict() (events []CacheEvent) {
+
+	for ByteSize(dc.size) > dc.maxSize() && dc.lruList.Len() > 0 {
+		e := dc.lruList.Back().Value.(*diskEntry)
+		dc.remove(e)
+		events = append(events, CacheEvent{Type: CacheEvict, Key: e.Key, Size: e.Size, Reason: "max size"})
+	}
+
+	return events
+}
+
+func (dc *DiskCache) emit(ev CacheEvent) {
+	if dc.OnEvent != nil {
+		dc.OnEvent(ev)
+	}
+}
+
+func (dc *DiskCache) emitAll(events []CacheEvent) {
+	for _, ev := range events {
+		dc.emit(ev)
+	}
+}
+
+// Writes the index, if it changed. The entries are copied under the lock,
+// and encoded and written outside of it, so readers don't wait for the disk.
+func (dc *DiskCache) flush() error {
+
+	dc.saveMtx.Lock()
+	defer dc.saveMtx.Unlock()
+
+	dc.mtx.Lock()
+
+	if !dc.dirty {
+		dc.mtx.Unlock()
+		return nil
+	}
+
+	// Entries are updated in place, so they are copied. Their headers and
+	// times are never modified, and may be shared
+	entries := make([]diskEntry, 0, len(dc.index))
+	for _, e := range dc.index {
+		entries = append(entries, *e)
+	}
+
+	dc.dirty = false
+
+	dc.mtx.Unlock()
+
+	b, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dc.Dir, diskIndexFile), b)
+	}
+
+	// Written again on the next flush
+	if err != nil {
+		dc.mtx.Lock()
+		dc.dirty = true
+		dc.mtx.Unlock()
+	}
+
+	return err
+}
+
+// Write to a temp file and rename it, so readers never see half a file
+func writeFileAtomic(path string, b []byte) error {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
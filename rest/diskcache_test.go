@@ -0,0 +1,256 @@
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+
+	dir := t.TempDir()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: &DiskCache{Dir: dir}}
+
+	resp := builder.Get("/cache/etag/user")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Status != OK (200)")
+	}
+
+	builder.Cache.Close()
+
+	// Same directory, new process
+	restarted := RequestBuilder{BaseURL: server.URL, Cache: &DiskCache{Dir: dir}}
+	defer restarted.Cache.Close()
+
+	cached := restarted.Get("/cache/etag/user")
+
+	if !cached.CacheHit() {
+		t.Fatal("Response should be cached after restart")
+	}
+
+	if cached.StatusCode != http.StatusOK || cached.String() != resp.String() {
+		t.Fatal("Cached Response should be the same as the original")
+	}
+
+	if cached.Header.Get("ETag") != "1234" {
+		t.Fatal("Cached Response should keep its headers")
+	}
+
+}
+
+func TestDiskCacheMaxSize(t *testing.T) {
+
+	cache := &DiskCache{Dir: t.TempDir(), MaxSize: 2 * KB}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	for i := 0; i < 20; i++ {
+		builder.Get("/cache/etag/user?i=" + strconv.Itoa(i))
+
+		if ByteSize(cache.size) > cache.MaxSize {
+			t.Fatal("Disk cache size " + strconv.FormatInt(cache.size, 10) + " is over MaxSize")
+		}
+	}
+
+	// Least recently used were removed first
+	if cache.get(server.URL+"/cache/etag/user?i=0") != nil {
+		t.Fatal("Oldest Response should have been evicted")
+	}
+
+	if cache.get(server.URL+"/cache/etag/user?i=19") == nil {
+		t.Fatal("Newest Response should be cached")
+	}
+
+	// Every entry shares the same body
+	if len(cache.bodies) != 1 {
+		t.Fatal("Bodies should be content-addressed")
+	}
+
+}
+
+func TestTieredCache(t *testing.T) {
+
+	dir := t.TempDir()
+
+	disk := &DiskCache{Dir: dir}
+	builder := RequestBuilder{BaseURL: server.URL, Cache: disk}
+	builder.Get("/cache/etag/user")
+	disk.Close()
+
+	memory := &ResourceCache{}
+	tiered := &TieredCache{L1: memory, L2: &DiskCache{Dir: dir}}
+	defer tiered.Close()
+
+	tieredBuilder := RequestBuilder{BaseURL: server.URL, Cache: tiered}
+
+	if !tieredBuilder.Get("/cache/etag/user").CacheHit() {
+		t.Fatal("Response should be found in L2")
+	}
+
+	if memory.get(server.URL+"/cache/etag/user") == nil {
+		t.Fatal("Response should be copied to L1")
+	}
+
+}
+
+func TestDiskCacheHeadersNotShared(t *testing.T) {
+
+	dir := t.TempDir()
+
+	cache := &DiskCache{Dir: dir, FlushInterval: 10 * time.Millisecond}
+	defer cache.Close()
+
+	value := &Response{
+		Response: &http.Response{StatusCode: http.StatusOK, Header: http.Header{"X-Test": {"stored"}}},
+		byteBody: []byte("body"),
+	}
+
+	cache.setNX("/disk/headers", value)
+	value.Header.Set("X-Test", "changed")
+
+	// Modified while the index is being written
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache.get("/disk/headers").Header.Set("X-Other", strconv.Itoa(i))
+			cache.set("/disk/other"+strconv.Itoa(i), value)
+		}(i)
+	}
+	wg.Wait()
+
+	resp := cache.get("/disk/headers")
+	if resp.Header.Get("X-Test") != "stored" || resp.Header.Get("X-Other") != "" {
+		t.Fatal("Cached headers should not change with the Responses")
+	}
+
+	// Written in the background, without Close
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, diskIndexFile))
+		if strings.Contains(string(b), "/disk/other9") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Index should be flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
+
+func TestTieredCacheMemoryLevels(t *testing.T) {
+
+	l1 := &ResourceCache{}
+	l2 := &ResourceCache{}
+
+	tiered := &TieredCache{L1: l1, L2: l2}
+	defer tiered.Close()
+
+	newResp := func(body string) *Response {
+		ttl := time.Now().Add(time.Minute)
+		return &Response{
+			Response: &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)},
+			byteBody: []byte(body),
+			ttl:      &ttl,
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		key := "/tiered/" + strconv.Itoa(i)
+		tiered.setNX(key, newResp("first"))
+		tiered.set(key, newResp("second"))
+	}
+
+	for i := 0; i < 3; i++ {
+		key := "/tiered/" + strconv.Itoa(i)
+		if l1.get(key).String() != "second" || l2.get(key).String() != "second" {
+			t.Fatal("Both levels should have the replaced Response")
+		}
+	}
+
+	// Found in L2 only, and copied to L1
+	l2.setNX("/tiered/l2", newResp("l2"))
+
+	if tiered.get("/tiered/l2").String() != "l2" || l1.get("/tiered/l2") == nil {
+		t.Fatal("Response should be copied to L1")
+	}
+
+	tiered.set("/tiered/l2", newResp("replaced"))
+
+	if l1.get("/tiered/l2").String() != "replaced" || l2.get("/tiered/l2").String() != "replaced" {
+		t.Fatal("Both levels should have the replaced Response")
+	}
+
+}
+
+func TestDiskCacheAccessOrderSaved(t *testing.T) {
+
+	dir := t.TempDir()
+	clock := newFakeClock()
+
+	cache := &DiskCache{Dir: dir, Clock: clock}
+	defer cache.Close()
+
+	for _, key := range []string{"/disk/a", "/disk/b"} {
+		cache.setNX(key, &Response{Response: &http.Response{StatusCode: http.StatusOK}, byteBody: []byte(key)})
+		clock.Advance(time.Second)
+	}
+
+	cache.flush()
+	cache.get("/disk/a")
+
+	if err := cache.flush(); err != nil {
+		t.Fatal("Flush failed", err)
+	}
+
+	// As loaded after a crash
+	b, _ := ioutil.ReadFile(filepath.Join(dir, diskIndexFile))
+
+	var entries []diskEntry
+	if err := json.Unmarshal(b, &entries); err != nil || len(entries) != 2 {
+		t.Fatal("Index should have both entries", err)
+	}
+
+	accessed := make(map[string]time.Time)
+	for _, e := range entries {
+		accessed[e.Key] = e.AccessedAt
+	}
+
+	if !accessed["/disk/a"].After(accessed["/disk/b"]) {
+		t.Fatal("Hits should be saved, so LRU order survives restarts")
+	}
+
+}
+
+func TestDiskCacheBadDir(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "file")
+	ioutil.WriteFile(file, nil, 0644)
+
+	var reasons []string
+
+	cache := &DiskCache{Dir: filepath.Join(file, "cache"), OnEvent: func(ev CacheEvent) {
+		reasons = append(reasons, ev.Reason)
+	}}
+
+	cache.setNX("/disk/a", &Response{Response: &http.Response{StatusCode: http.StatusOK}, byteBody: []byte("a")})
+
+	if len(reasons) != 1 || reasons[0] != "write error" {
+		t.Fatal("Store should fail with a write error event", reasons)
+	}
+
+	if cache.Close() == nil {
+		t.Fatal("Close should return why Dir can't be used")
+	}
+
+}
@@ -46,6 +46,48 @@
 // and objects are flushed based on time expiration (TTL) or by hitting the maximum
 // memory limit. In the last case, least accessed objects will be removed first.
 //
+// By default, Responses are cached in memory. A DiskCache keeps them in a
+// directory, so restarts begin warm. A TieredCache puts a memory cache in front:
+//  rb := rest.RequestBuilder{
+//    Cache: &rest.TieredCache{
+//      L1: &rest.ResourceCache{MaxSize: 100 * rest.MB},
+//      L2: &rest.DiskCache{Dir: "/var/cache/myapp", MaxSize: 2 * rest.GB},
+//    },
+//  }
+//
+// Large bodies may be stored gzipped, so the same MaxSize holds more of them.
+// They are decompressed when read, by Bytes, String or FillUp:
+//  rb := rest.RequestBuilder{
+//    Cache: &rest.ResourceCache{CompressAbove: 4 * rest.KB},
+//  }
+//
+// Cache directives may be set per request, with Do:
+//  resp := rb.Do(&rest.Request{
+//    Method:       http.MethodGet,
+//    URL:          "/resource",
+//    CacheControl: &rest.CacheControl{OnlyIfCached: true, MaxStale: time.Minute},
+//  })
+//
+// Edge and CLI tools may keep working without network. With StaleIfOffline,
+// cached Responses are served, flagged as Stale, on DNS or connection errors.
+// With Offline, the network is never used. Either way the Cache keeps expired
+// Responses, until evicted by size:
+//  rb := rest.RequestBuilder{
+//    StaleIfOffline: true,
+//  }
+//
+// Cache behavior can be observed with an OnEvent hook, called on insert, hit,
+// miss, revalidate, expire and evict, with the key, size and reason:
+//  cache := &rest.ResourceCache{
+//    OnEvent: func(ev rest.CacheEvent) { metrics.Inc(ev.Type.String()) },
+//  }
+//
+// Hot Responses may be refreshed in the background before they expire, so
+// their readers never wait for the upstream:
+//  rb := rest.RequestBuilder{
+//    RefreshAhead: &rest.RefreshAhead{Window: 0.1, MinHits: 2},
+//  }
+//
 // Examples
 //
 // Installation
@@ -118,8 +160,19 @@
 //  // This will be printed first.
 //  fmt.Println("print first")
 //
+// Shutdown
+//
+// Caches start their goroutine on first use, and RequestBuilders keep idle
+// connections open. For a graceful shutdown, waiting for requests in flight
+// (Async and ForkJoin ones included) before closing idle connections:
+//  ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//  defer cancel()
+//
+//  rb.Shutdown(ctx)
+//  rest.Shutdown(ctx) // DefaultBuilder and default cache
+//
 // Defaults
-// * Headers: keep-alive, Cache-Control: no-cache
+// * Headers: keep-alive. Cache-Control only when a Request sets CacheControl
 // * Timeout: 2 seconds
 // * ContentType: JSON (for body requests in POST, PUT and PATCH)
 // * Cache: enable
@@ -174,4 +227,37 @@
 //  rest.AddMockups(&mock)
 //
 //  v := rest.Get(myURL)
+//
+// Tests running in parallel should use their own MockServer, closed when the
+// test ends, and attach their RequestBuilders to it
+//  ms := rest.NewMockServer(t)
+//  ms.AddMockups(&mock)
+//
+//  rb := rest.RequestBuilder{MockServer: ms}
+//  v := rb.Get(myURL)
+//
+// Requests no mock matches get a 400 (Bad Request), with the closest mocks
+// and how they differ in the body. In Strict mode, they fail the test too,
+// when it ends
+//  ms.Strict = true
+//
+// Instead of writing mocks by hand, they can be recorded from the real
+// upstream to a cassette, and replayed later
+//  ms.UseCassette(&rest.Cassette{
+//  	Path: "testdata/foo.json",
+//  	Mode: rest.CassetteReplayOrRecord,
+//  })
+//
+// Or loaded from JSON and YAML fixture files
+//  ms.AddMockupsFromDir("testdata/mocks")
+//
+// Responses computed from the request are written by a Handler, or by a
+// RespBody template
+//  mock := rest.Mock{
+//  	URLPattern:   "http://mytest.com/users/{id}",
+//  	HTTPMethod:   http.MethodGet,
+//  	RespHTTPCode: http.StatusOK,
+//  	RespTemplate: true,
+//  	RespBody:     `{"id": {{.Vars.id}}, "at": {{now.Unix}}}`,
+//  }
 package rest
@@ -0,0 +1,403 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CassetteMode is what a MockServer does with its Cassette
+type CassetteMode int
+
+const (
+	// CassetteReplay serves the recorded interactions. Requests matching
+	// none of them are not found, as with any other mock
+	CassetteReplay CassetteMode = iota
+
+	// CassetteRecord sends every request upstream, and records it.
+	// The cassette is overwritten
+	CassetteRecord
+
+	// CassetteReplayOrRecord serves the recorded interactions, and sends the
+	// requests matching none upstream, adding them to the cassette
+	CassetteReplayOrRecord
+)
+
+// Redacted replaces the values of redacted headers in cassettes
+const Redacted = "REDACTED"
+
+// BodyBase64 is the BodyEncoding of recorded bodies that are not valid UTF-8
+const BodyBase64 = "base64"
+
+// DefaultRedactHeaders are the headers redacted when a Cassette sets none
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Cassette records the interactions of a MockServer with the real upstream
+// to a file, and replays them as mocks, so large responses don't have to be
+// written by hand.
+//
+//	ms := rest.NewMockServer(t)
+//	ms.UseCassette(&rest.Cassette{Path: "testdata/users.json", Mode: rest.CassetteReplayOrRecord})
+//
+// The cassette is saved when the MockServer is closed. Bodies are stored as
+// text, or in base64 when they are not valid UTF-8.
+type Cassette struct {
+
+	// File where interactions are stored, as JSON
+	Path string
+
+	Mode CassetteMode
+
+	// Base URL requests are sent to when recording, instead of their own
+	// scheme and host, as a local stand-in. Empty means the original URL
+	Upstream string
+
+	// Client used to record. Nil means one that doesn't follow redirects,
+	// so they are recorded as they are
+	Client *http.Client
+
+	// Request headers an interaction must match to be replayed, besides
+	// method and URL. Redacted values are not matched
+	MatchHeaders []string
+
+	// The request body must match to be replayed. JSON bodies are compared
+	// as JSON values
+	MatchBody bool
+
+	// Headers whose values are replaced by Redacted, in requests and
+	// responses. Nil means DefaultRedactHeaders
+	RedactHeaders []string
+
+	mtx          sync.Mutex
+	upstream     *url.URL
+	interactions []Interaction
+	dirty        bool
+}
+
+// Interaction is a request and its response, as recorded in a Cassette
+type Interaction struct {
+	Request  CassetteRequest  `json:"request"`
+	Response CassetteResponse `json:"response"`
+}
+
+// CassetteRequest is a recorded request
+type CassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+
+	// Empty for text bodies, BodyBase64 for encoded ones
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+// CassetteResponse is a recorded response
+type CassetteResponse struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+
+	// Empty for text bodies, BodyBase64 for encoded ones
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+var defaultCassetteClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// UseCassette attaches a Cassette to the server. Unless recording, its
+// interactions are loaded as mocks. A missing file is an error only in
+// CassetteReplay mode.
+func (ms *MockServer) UseCassette(c *Cassette) error {
+
+	if c.Upstream != "" {
+		upstream, err := url.Parse(c.Upstream)
+		if err != nil {
+			return err
+		}
+		c.upstream = upstream
+	}
+
+	if c.Mode != CassetteRecord {
+
+		err := c.load()
+		if os.IsNotExist(err) && c.Mode == CassetteReplayOrRecord {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := ms.AddMockups(c.mocks()...); err != nil {
+			return err
+		}
+	}
+
+	ms.mtx.Lock()
+	ms.cassette = c
+	ms.mtx.Unlock()
+
+	return nil
+}
+
+// Interactions returns the interactions of the cassette, in order.
+func (c *Cassette) Interactions() []Interaction {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return append([]Interaction(nil), c.interactions...)
+}
+
+// Save writes the cassette, if something was recorded since it was loaded.
+func (c *Cassette) Save() error {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(c.Path, b); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+func (c *Cassette) load() error {
+
+	b, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+
+	var file cassetteFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return errors.New("Error parsing cassette " + c.Path + ". Cause: " + err.Error())
+	}
+
+	for _, in := range file.Interactions {
+		if _, err := decodeBody(in.Request.Body, in.Request.BodyEncoding); err != nil {
+			return errors.New("Error parsing cassette " + c.Path + ". Cause: " + err.Error())
+		}
+		if _, err := decodeBody(in.Response.Body, in.Response.BodyEncoding); err != nil {
+			return errors.New("Error parsing cassette " + c.Path + ". Cause: " + err.Error())
+		}
+	}
+
+	c.mtx.Lock()
+	c.interactions = file.Interactions
+	c.mtx.Unlock()
+
+	return nil
+}
+
+// One mock per distinct request, serving its responses in the recorded order
+func (c *Cassette) mocks() []*Mock {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var mocks []*Mock
+	byRequest := make(map[string]*Mock)
+
+	for _, in := range c.interactions {
+
+		m := c.mock(in)
+
+		key, _ := json.Marshal([]interface{}{m.HTTPMethod, m.URL, m.ReqHeaders, m.ReqBody})
+
+		if prev := byRequest[string(key)]; prev != nil {
+			prev.Responses = append(prev.Responses, m.Responses...)
+			continue
+		}
+
+		byRequest[string(key)] = m
+		mocks = append(mocks, m)
+	}
+
+	return mocks
+}
+
+// Lock must be held. Bodies were checked when loaded
+func (c *Cassette) mock(in Interaction) *Mock {
+
+	respBody, _ := decodeBody(in.Response.Body, in.Response.BodyEncoding)
+
+	m := &Mock{
+		URL:        in.Request.URL,
+		HTTPMethod: in.Request.Method,
+		Responses: []MockResponse{{
+			HTTPCode: in.Response.StatusCode,
+			Headers:  in.Response.Header,
+			Body:     respBody,
+		}},
+	}
+
+	for _, k := range c.MatchHeaders {
+		for _, v := range in.Request.Header[http.CanonicalHeaderKey(k)] {
+			if v == Redacted {
+				continue
+			}
+			if m.ReqHeaders == nil {
+				m.ReqHeaders = make(http.Header)
+			}
+			m.ReqHeaders.Add(k, v)
+		}
+	}
+
+	if c.MatchBody {
+		m.ReqBody, _ = decodeBody(in.Request.Body, in.Request.BodyEncoding)
+		if mediaType, _, _ := mime.ParseMediaType(in.Request.Header.Get("Content-Type")); mediaType == "application/json" {
+			m.ReqBodyMatch = BodyJSON
+		}
+	}
+
+	return m
+}
+
+func (c *Cassette) client() *http.Client {
+
+	if c.Client != nil {
+		return c.Client
+	}
+
+	return defaultCassetteClient
+}
+
+// Sends the request upstream, serves its response, and records both.
+// Returns the interaction recorded, nil if the upstream failed.
+func (c *Cassette) proxy(writer http.ResponseWriter, req *http.Request, reqURL *url.URL, body []byte) *Interaction {
+
+	target := *reqURL
+	if c.upstream != nil {
+		target.Scheme = c.upstream.Scheme
+		target.Host = c.upstream.Host
+	}
+
+	out, err := http.NewRequest(req.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte(err.Error()))
+		return nil
+	}
+
+	// Without Accept-Encoding, the body is recorded decompressed
+	out.Header = req.Header.Clone()
+	out.Header.Del("X-Original-URL")
+	out.Header.Del("Accept-Encoding")
+
+	resp, err := c.client().Do(out)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte(err.Error()))
+		return nil
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte(err.Error()))
+		return nil
+	}
+
+	// The length is set again when served
+	header := resp.Header.Clone()
+	header.Del("Content-Length")
+
+	writeMockResponse(writer, MockResponse{HTTPCode: resp.StatusCode, Headers: header}, respBody)
+
+	in := Interaction{
+		Request: CassetteRequest{
+			Method: req.Method,
+			URL:    reqURL.String(),
+			Header: c.redact(out.Header),
+		},
+		Response: CassetteResponse{
+			StatusCode: resp.StatusCode,
+			Header:     c.redact(header),
+		},
+	}
+
+	in.Request.Body, in.Request.BodyEncoding = encodeBody(body)
+	in.Response.Body, in.Response.BodyEncoding = encodeBody(respBody)
+
+	c.mtx.Lock()
+	c.interactions = append(c.interactions, in)
+	c.dirty = true
+	c.mtx.Unlock()
+
+	return &in
+}
+
+// A copy of the headers, with the secrets redacted
+func (c *Cassette) redact(h http.Header) http.Header {
+
+	redactHeaders := c.RedactHeaders
+	if redactHeaders == nil {
+		redactHeaders = DefaultRedactHeaders
+	}
+
+	h = h.Clone()
+
+	for _, k := range redactHeaders {
+		k = http.CanonicalHeaderKey(k)
+		for i := range h[k] {
+			h[k][i] = Redacted
+		}
+	}
+
+	return h
+}
+
+// The body as stored, and its encoding. Bodies that are not valid UTF-8
+// would be mangled as JSON strings, so they are stored in base64
+func encodeBody(body []byte) (string, string) {
+
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), BodyBase64
+}
+
+func decodeBody(body string, encoding string) (string, error) {
+
+	switch encoding {
+	case "":
+		return body, nil
+
+	case BodyBase64:
+		b, err := base64.StdEncoding.DecodeString(body)
+		return string(b), err
+	}
+
+	return "", errors.New("unknown body encoding " + encoding)
+}
@@ -0,0 +1,303 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// How many of the closest mocks an unmatched request report shows
+const mockMissCandidates = 3
+
+// A mock compared to a request no mock matched
+type mockCandidate struct {
+	mock  *mockEntry
+	score float64
+	diffs []string
+}
+
+// The report of a request no mock matched: the key looked up, and the
+// closest mocks, with what differs from the request. Its first line is
+// MOCK_NOT_FOUND_ERROR. Lock must be held
+func (ms *MockServer) missReport(key string, reqURL *url.URL, req *http.Request, body []byte) string {
+
+	var candidates []mockCandidate
+	for _, m := range ms.allMocks() {
+		candidates = append(candidates, ms.compare(m, reqURL, req, body))
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].mock.seq > candidates[j].mock.seq
+	})
+
+	var b strings.Builder
+
+	b.WriteString(MOCK_NOT_FOUND_ERROR + "\n")
+	fmt.Fprintf(&b, "No mock matches %s %s\n", req.Method, reqURL)
+	fmt.Fprintf(&b, "Looked up key: %s\n", key)
+
+	if len(candidates) == 0 {
+		b.WriteString("There are no mocks\n")
+		return b.String()
+	}
+
+	if len(candidates) > mockMissCandidates {
+		candidates = candidates[:mockMissCandidates]
+	}
+
+	b.WriteString("Closest mocks:\n")
+
+	for i, c := range candidates {
+		fmt.Fprintf(&b, "%d. %s %s\n", i+1, c.mock.HTTPMethod, c.mock.mockURL())
+		for _, d := range c.diffs {
+			fmt.Fprintf(&b, "   - %s\n", d)
+		}
+	}
+
+	return b.String()
+}
+
+// Fails the test once per unmatched request, with its report
+func (ms *MockServer) reportMisses(t MockT) {
+
+	t.Helper()
+
+	ms.mtx.RLock()
+	misses := ms.misses
+	ms.mtx.RUnlock()
+
+	for _, miss := range misses {
+		t.Errorf("%s", miss)
+	}
+}
+
+// What differs between the mock and the request. The score is higher the
+// closer they are: a point for each part that matches, and the similarity
+// of the URLs. Lock must be held
+func (ms *MockServer) compare(m *mockEntry, reqURL *url.URL, req *http.Request, body []byte) mockCandidate {
+
+	c := mockCandidate{mock: m}
+
+	check := func(ok bool, diffs ...string) {
+		if ok {
+			c.score++
+		} else {
+			c.diffs = append(c.diffs, diffs...)
+		}
+	}
+
+	check(m.HTTPMethod == req.Method, fmt.Sprintf("method: want %s, got %s", m.HTTPMethod, req.Method))
+
+	urlDiffs, similarity := m.diffURL(reqURL)
+	check(len(urlDiffs) == 0, urlDiffs...)
+	c.score += similarity
+
+	check(m.matchQuery(reqURL.Query()), diffValues("query param", m.ReqQuery, reqURL.Query())...)
+
+	check(m.matchHeaders(req.Header), m.diffHeaders(req.Header)...)
+
+	if !m.matchBody(body) {
+		if m.ReqBodyFunc != nil {
+			c.diffs = append(c.diffs, "body: rejected by ReqBodyFunc")
+		} else {
+			c.diffs = append(c.diffs, fmt.Sprintf("body: want %s, got %s", quoteBody(m.ReqBody), quoteBody(string(body))))
+		}
+	} else {
+		c.score++
+	}
+
+	if m.Times > 0 && m.calls >= m.Times {
+		c.diffs = append(c.diffs, fmt.Sprintf("times: already served %d times", m.calls))
+	}
+
+	if m.Scenario != "" && m.RequiredState != "" {
+		if state := ms.scenarioState(m.Scenario); state != m.RequiredState {
+			c.diffs = append(c.diffs, fmt.Sprintf("scenario %s: want state %s, got %s", m.Scenario, m.RequiredState, state))
+		}
+	}
+
+	return c
+}
+
+// The differences in the URL, and how similar it is, from 0 to 1
+func (m *mockEntry) diffURL(reqURL *url.URL) ([]string, float64) {
+
+	if m.urlRegexp != nil {
+
+		if _, ok := m.matchURL(reqURL); ok {
+			return nil, 1
+		}
+
+		what := "pattern"
+		if m.URLPattern == "" {
+			what = "regexp"
+		}
+
+		s := reqURL.String()
+		if strings.HasPrefix(m.URLPattern, "/") {
+			s = reqURL.EscapedPath()
+		}
+
+		return []string{fmt.Sprintf("url: %s does not match %s %s", s, what, m.mockURL())}, similarity(m.mockURL(), s)
+	}
+
+	mockURL, err := url.Parse(m.URL)
+	if err != nil {
+		return []string{"url: " + err.Error()}, 0
+	}
+
+	var diffs []string
+
+	if mockURL.Scheme != reqURL.Scheme || mockURL.Host != reqURL.Host {
+		diffs = append(diffs, fmt.Sprintf("host: want %s://%s, got %s://%s", mockURL.Scheme, mockURL.Host, reqURL.Scheme, reqURL.Host))
+	}
+
+	if mockURL.EscapedPath() != reqURL.EscapedPath() {
+		diffs = append(diffs, fmt.Sprintf("path: want %s, got %s", mockURL.EscapedPath(), reqURL.EscapedPath()))
+	}
+
+	if !m.IgnoreQuery {
+		diffs = append(diffs, diffValues("query param", mockURL.Query(), reqURL.Query())...)
+		diffs = append(diffs, extraValues("query param", mockURL.Query(), reqURL.Query())...)
+	}
+
+	noQuery := *mockURL
+	noQuery.RawQuery = ""
+	reqNoQuery := *reqURL
+	reqNoQuery.RawQuery = ""
+
+	return diffs, similarity(noQuery.String(), reqNoQuery.String())
+}
+
+func (m *mockEntry) diffHeaders(h http.Header) []string {
+
+	diffs := diffValues("header", m.ReqHeaders, h)
+
+	for _, k := range m.ReqHeadersPresent {
+		if _, ok := h[http.CanonicalHeaderKey(k)]; !ok {
+			diffs = append(diffs, fmt.Sprintf("header %s: missing", k))
+		}
+	}
+
+	for k, re := range m.headersRegexp {
+		if !re.MatchString(h.Get(k)) {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q does not match %s", k, h.Get(k), re))
+		}
+	}
+
+	sort.Strings(diffs)
+
+	return diffs
+}
+
+// Values wanted that are missing or different
+func diffValues(what string, want map[string][]string, got map[string][]string) []string {
+
+	var diffs []string
+
+	for k, values := range want {
+
+		gotValues := got[k]
+		if what == "header" {
+			gotValues = got[http.CanonicalHeaderKey(k)]
+		}
+
+		for _, v := range values {
+			switch {
+			case len(gotValues) == 0:
+				diffs = append(diffs, fmt.Sprintf("%s %s: want %q, missing", what, k, v))
+			case !containsString(gotValues, v):
+				diffs = append(diffs, fmt.Sprintf("%s %s: want %q, got %q", what, k, v, strings.Join(gotValues, ", ")))
+			}
+		}
+	}
+
+	sort.Strings(diffs)
+
+	return diffs
+}
+
+// Values not wanted
+func extraValues(what string, want map[string][]string, got map[string][]string) []string {
+
+	var diffs []string
+
+	for k, values := range got {
+		if _, ok := want[k]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s %s: unexpected %q", what, k, strings.Join(values, ", ")))
+		}
+	}
+
+	sort.Strings(diffs)
+
+	return diffs
+}
+
+// Bodies are quoted and shortened, to keep reports readable
+func quoteBody(body string) string {
+
+	const max = 200
+
+	if len(body) > max {
+		return fmt.Sprintf("%q... (%d bytes)", body[:max], len(body))
+	}
+
+	return fmt.Sprintf("%q", body)
+}
+
+// How similar two strings are, from 0 to 1, by their edit distance
+func similarity(a string, b string) float64 {
+
+	if a == b {
+		return 1
+	}
+
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+
+	return 1 - float64(editDistance(a, b))/float64(longest)
+}
+
+// Levenshtein distance, in bytes
+func editDistance(a string, b string) int {
+
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+
+		curr[0] = i
+
+		for j := 1; j <= len(b); j++ {
+
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,182 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MockFault are the faults and latency injected when serving a Mock, to test
+// how timeouts and broken connections are handled.
+type MockFault struct {
+
+	// Delay before sending the headers
+	Delay time.Duration
+
+	// Maximum random delay, added to Delay
+	DelayJitter time.Duration
+
+	// Delay after sending the headers, before the body
+	BodyDelay time.Duration
+
+	// Send the body DripBytes at a time, waiting DripInterval between them.
+	// Zero DripBytes means 1
+	DripInterval time.Duration
+	DripBytes    int
+
+	// Close the connection without sending anything
+	DropConnection bool
+
+	// Send half the body, with the Content-Length of the whole one, and close
+	// the connection
+	TruncateBody bool
+
+	// Send the body with a malformed chunked encoding
+	MalformedChunked bool
+}
+
+// Writes the response of a mock, injecting its faults.
+// The wait is cut short if the client goes away.
+func (fault *MockFault) serve(writer http.ResponseWriter, req *http.Request, resp MockResponse, body []byte) {
+
+	ctx := req.Context()
+
+	if fault == nil {
+		writeMockResponse(writer, resp, body)
+		return
+	}
+
+	delay := fault.Delay
+	if fault.DelayJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(fault.DelayJitter)))
+	}
+
+	if !sleepCtx(ctx, delay) {
+		return
+	}
+
+	switch {
+	case fault.DropConnection:
+		if conn, _, err := hijack(writer); err == nil {
+			conn.Close()
+		}
+		return
+
+	case fault.TruncateBody:
+		writeRaw(writer, resp, "Content-Length: "+strconv.Itoa(len(body)), body[:len(body)/2])
+		return
+
+	case fault.MalformedChunked:
+		writeRaw(writer, resp, "Transfer-Encoding: chunked", []byte("zz\r\n"+string(body)+"\r\n"))
+		return
+	}
+
+	addHeaders(writer, resp.Headers)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(resp.HTTPCode)
+	flush(writer)
+
+	if !sleepCtx(ctx, fault.BodyDelay) {
+		return
+	}
+
+	if fault.DripInterval <= 0 {
+		writer.Write(body)
+		return
+	}
+
+	n := fault.DripBytes
+	if n <= 0 {
+		n = 1
+	}
+
+	for len(body) > 0 {
+
+		if n > len(body) {
+			n = len(body)
+		}
+
+		writer.Write(body[:n])
+		flush(writer)
+		body = body[n:]
+
+		if len(body) > 0 && !sleepCtx(ctx, fault.DripInterval) {
+			return
+		}
+	}
+}
+
+func writeMockResponse(writer http.ResponseWriter, resp MockResponse, body []byte) {
+	addHeaders(writer, resp.Headers)
+	writer.WriteHeader(resp.HTTPCode)
+	writer.Write(body)
+}
+
+func addHeaders(writer http.ResponseWriter, h http.Header) {
+	for k, v := range h {
+		for _, vv := range v {
+			writer.Header().Add(k, vv)
+		}
+	}
+}
+
+func flush(writer http.ResponseWriter) {
+	if f, ok := writer.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Sleeps, unless the context is done first. Returns false if it was.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func hijack(writer http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+
+	hj, ok := writer.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection can't be hijacked")
+	}
+
+	return hj.Hijack()
+}
+
+// Writes a response by hand, with an extra header, and closes the connection
+func writeRaw(writer http.ResponseWriter, resp MockResponse, header string, body []byte) {
+
+	conn, rw, err := hijack(writer)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The framing is only the one given, not any the mock sets
+	headers := resp.Headers.Clone()
+	headers.Del("Content-Length")
+	headers.Del("Transfer-Encoding")
+
+	fmt.Fprintf(rw, "HTTP/1.1 %d %s\r\n", resp.HTTPCode, http.StatusText(resp.HTTPCode))
+	headers.Write(rw)
+	fmt.Fprintf(rw, "%s\r\n\r\n", header)
+	rw.Write(body)
+	rw.Flush()
+}
@@ -0,0 +1,572 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FixtureError is an error in a fixture file, at a line
+type FixtureError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *FixtureError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err.Error())
+}
+
+func (e *FixtureError) Unwrap() error {
+	return e.Err
+}
+
+// mockFixture is a Mock as written in a fixture file.
+//
+// A body may be a string, or any JSON value, sent as JSON. It may also be
+// read from a file, relative to the fixture.
+type mockFixture struct {
+	URL               string            `json:"url"`
+	URLPattern        string            `json:"urlPattern"`
+	URLRegexp         string            `json:"urlRegexp"`
+	Method            string            `json:"method"`
+	ReqQuery          fixtureValues     `json:"reqQuery"`
+	IgnoreQuery       bool              `json:"ignoreQuery"`
+	ReqHeaders        fixtureValues     `json:"reqHeaders"`
+	ReqHeadersPresent []string          `json:"reqHeadersPresent"`
+	ReqHeadersRegexp  map[string]string `json:"reqHeadersRegexp"`
+	ReqBody           json.RawMessage   `json:"reqBody"`
+	ReqBodyMatch      string            `json:"reqBodyMatch"`
+	Status            int               `json:"status"`
+	Headers           fixtureValues     `json:"headers"`
+	Body              json.RawMessage   `json:"body"`
+	BodyFile          string            `json:"bodyFile"`
+	Responses         []fixtureResponse `json:"responses"`
+	Template          bool              `json:"template"`
+	Times             int               `json:"times"`
+	Scenario          string            `json:"scenario"`
+	RequiredState     string            `json:"requiredState"`
+	NewState          string            `json:"newState"`
+}
+
+type fixtureResponse struct {
+	Status   int             `json:"status"`
+	Headers  fixtureValues   `json:"headers"`
+	Body     json.RawMessage `json:"body"`
+	BodyFile string          `json:"bodyFile"`
+	Repeat   int             `json:"repeat"`
+}
+
+// Headers and query params. Each value is a string, or a list of them
+type fixtureValues map[string][]string
+
+func (v *fixtureValues) UnmarshalJSON(b []byte) error {
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*v = make(fixtureValues, len(raw))
+
+	for k, r := range raw {
+
+		var s string
+		if json.Unmarshal(r, &s) == nil {
+			(*v)[k] = []string{s}
+			continue
+		}
+
+		var list []string
+		if err := json.Unmarshal(r, &list); err != nil {
+			return &fixtureKeyError{key: k, msg: k + " must be a string or a list of strings"}
+		}
+
+		(*v)[k] = list
+	}
+
+	return nil
+}
+
+// An error about a key, to be found in the fixture for its line
+type fixtureKeyError struct {
+	key string
+	msg string
+}
+
+func (e *fixtureKeyError) Error() string {
+	return e.msg
+}
+
+var unknownFieldError = regexp.MustCompile(`unknown field "([^"]*)"`)
+
+// AddMockupsFromFile adds the mocks of a JSON (.json) or YAML (.yaml, .yml)
+// fixture file. It has a list of mocks, or a single one, as in
+//
+//	urlPattern: http://mytest.com/users/{id}
+//	method: GET
+//	status: 200
+//	headers:
+//	  Content-Type: application/json
+//	bodyFile: bodies/user.json
+//
+// Keys are named as the Mock fields, in lower camel case: url, urlPattern,
+// urlRegexp, method, reqQuery, ignoreQuery, reqHeaders, reqHeadersPresent,
+// reqHeadersRegexp, reqBody, reqBodyMatch (exact, json or xml), status,
+// headers, body, bodyFile, responses, template, times, scenario,
+// requiredState and newState. Responses have status, headers, body,
+// bodyFile and repeat.
+//
+// The method defaults to GET and the status to 200. Bodies that are not
+// strings are sent as JSON. Either every mock of the file is added, or none.
+// Errors are *FixtureError, with the line of the mistake.
+func (ms *MockServer) AddMockupsFromFile(path string) error {
+
+	mocks, _, err := loadFixtureFile(path)
+	if err != nil {
+		return err
+	}
+
+	return ms.replaceMockups(nil, mocks)
+}
+
+// AddMockupsFromDir adds the mocks of every fixture file in a directory, in
+// name order. Files in subdirectories are not loaded, so they may hold body
+// files.
+func (ms *MockServer) AddMockupsFromDir(dir string) error {
+
+	mocks, _, err := loadFixtureDir(dir)
+	if err != nil {
+		return err
+	}
+
+	return ms.replaceMockups(nil, mocks)
+}
+
+// WatchMockups adds the mocks of a fixture file or directory, and reloads
+// them whenever the fixtures or their body files change, checking every
+// interval. It is meant for local development.
+//
+// When a reload fails, the mocks loaded before are kept, and the error is
+// passed to onError, if not nil. Watching stops when the returned function
+// is called, or the server is closed.
+func (ms *MockServer) WatchMockups(path string, interval time.Duration, onError func(error)) (func(), error) {
+
+	mocks, files, err := loadFixtures(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ms.replaceMockups(nil, mocks); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+
+	ms.mtx.Lock()
+	ms.watchers = append(ms.watchers, stop)
+	ms.mtx.Unlock()
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		stamp := fixtureStamp(path, files)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if s := fixtureStamp(path, files); s == stamp {
+				continue
+			}
+
+			newMocks, newFiles, err := loadFixtures(path)
+			if err == nil {
+				err = ms.replaceMockups(mocks, newMocks)
+			}
+
+			// Not reloaded again until something else changes
+			files = newFiles
+			stamp = fixtureStamp(path, files)
+
+			if err != nil {
+				if onError != nil {
+					onError(err)
+				}
+				continue
+			}
+
+			mocks = newMocks
+		}
+	}()
+
+	return stop, nil
+}
+
+// AddMockupsFromFile adds the mocks of a fixture file, see MockServer.
+func AddMockupsFromFile(path string) error {
+	return globalMock.AddMockupsFromFile(path)
+}
+
+// AddMockupsFromDir adds the mocks of the fixture files of a directory, see MockServer.
+func AddMockupsFromDir(dir string) error {
+	return globalMock.AddMockupsFromDir(dir)
+}
+
+// Mocks of a file or directory, and the files they were loaded from
+func loadFixtures(path string) ([]*Mock, []string, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, []string{path}, err
+	}
+
+	if info.IsDir() {
+		return loadFixtureDir(path)
+	}
+
+	return loadFixtureFile(path)
+}
+
+func isFixtureFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func loadFixtureDir(dir string) ([]*Mock, []string, error) {
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mocks []*Mock
+	var files []string
+
+	for _, info := range infos {
+
+		if info.IsDir() || !isFixtureFile(info.Name()) {
+			continue
+		}
+
+		fileMocks, fileFiles, err := loadFixtureFile(filepath.Join(dir, info.Name()))
+		files = append(files, fileFiles...)
+		if err != nil {
+			return nil, files, err
+		}
+
+		mocks = append(mocks, fileMocks...)
+	}
+
+	return mocks, files, nil
+}
+
+// The mocks of a fixture file, and the files read: the fixture and its bodies
+func loadFixtureFile(path string) ([]*Mock, []string, error) {
+
+	files := []string{path}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, files, err
+	}
+
+	var root *fixtureNode
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		root, err = parseJSONNode(data)
+	case ".yaml", ".yml":
+		root, err = parseYAMLNode(data)
+	default:
+		return nil, files, errors.New("Unknown fixture format " + path + ". Use .json, .yaml or .yml")
+	}
+
+	if err != nil {
+		if fe, ok := err.(*FixtureError); ok {
+			fe.File = path
+		}
+		return nil, files, err
+	}
+
+	items, ok := root.value.([]*fixtureNode)
+	if !ok {
+		items = []*fixtureNode{root}
+	}
+
+	var mocks []*Mock
+
+	for _, item := range items {
+
+		// Empty items, as a commented out one, add nothing
+		if item.value == nil {
+			continue
+		}
+
+		m, bodyFiles, err := decodeFixture(item, filepath.Dir(path))
+		files = append(files, bodyFiles...)
+		if err != nil {
+			if fe, ok := err.(*FixtureError); ok {
+				fe.File = path
+			}
+			return nil, files, err
+		}
+
+		mocks = append(mocks, m)
+	}
+
+	return mocks, files, nil
+}
+
+// A mock out of its node, with any body file read from dir
+func decodeFixture(item *fixtureNode, dir string) (*Mock, []string, error) {
+
+	if _, ok := item.value.(map[string]*fixtureNode); !ok {
+		return nil, nil, &FixtureError{Line: item.line, Err: errors.New("a mock must be a mapping of keys to values")}
+	}
+
+	b, err := json.Marshal(item.plain())
+	if err != nil {
+		return nil, nil, &FixtureError{Line: item.line, Err: err}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+
+	var f mockFixture
+	if err := decoder.Decode(&f); err != nil {
+		return nil, nil, &FixtureError{Line: fixtureErrorLine(item, err), Err: err}
+	}
+
+	fail := func(key string, msg string) (*Mock, []string, error) {
+		line := item.lineOfKey(key)
+		if line == 0 {
+			line = item.line
+		}
+		return nil, nil, &FixtureError{Line: line, Err: errors.New(msg)}
+	}
+
+	if f.URL == "" && f.URLPattern == "" && f.URLRegexp == "" {
+		return fail("", "a mock needs an url, urlPattern or urlRegexp")
+	}
+
+	m := &Mock{
+		URL:               f.URL,
+		URLPattern:        f.URLPattern,
+		URLRegexp:         f.URLRegexp,
+		HTTPMethod:        strings.ToUpper(f.Method),
+		ReqQuery:          map[string][]string(f.ReqQuery),
+		IgnoreQuery:       f.IgnoreQuery,
+		ReqHeadersPresent: f.ReqHeadersPresent,
+		ReqHeadersRegexp:  f.ReqHeadersRegexp,
+		RespTemplate:      f.Template,
+		Times:             f.Times,
+		Scenario:          f.Scenario,
+		RequiredState:     f.RequiredState,
+		NewState:          f.NewState,
+	}
+
+	if m.HTTPMethod == "" {
+		m.HTTPMethod = http.MethodGet
+	}
+
+	if f.ReqHeaders != nil {
+		m.ReqHeaders = canonicalHeader(f.ReqHeaders)
+	}
+
+	var isJSON bool
+	m.ReqBody, isJSON = fixtureBody(f.ReqBody)
+
+	switch strings.ToLower(f.ReqBodyMatch) {
+	case "":
+		if isJSON {
+			m.ReqBodyMatch = BodyJSON
+		}
+	case "exact":
+		m.ReqBodyMatch = BodyExact
+	case "json":
+		m.ReqBodyMatch = BodyJSON
+	case "xml":
+		m.ReqBodyMatch = BodyXML
+	default:
+		return fail("reqBodyMatch", "reqBodyMatch must be exact, json or xml")
+	}
+
+	var files []string
+
+	if len(f.Responses) == 0 {
+		f.Responses = []fixtureResponse{{Status: f.Status, Headers: f.Headers, Body: f.Body, BodyFile: f.BodyFile}}
+	} else if f.Status != 0 || f.Headers != nil || f.Body != nil || f.BodyFile != "" {
+		return fail("responses", "a mock has either responses, or status, headers and body")
+	}
+
+	for i, r := range f.Responses {
+
+		resp := MockResponse{HTTPCode: r.Status, Repeat: r.Repeat}
+
+		if resp.HTTPCode == 0 {
+			resp.HTTPCode = http.StatusOK
+		}
+
+		if r.Headers != nil {
+			resp.Headers = canonicalHeader(r.Headers)
+		}
+
+		body, isJSON := fixtureBody(r.Body)
+
+		if r.BodyFile != "" {
+
+			if r.Body != nil {
+				return fail("bodyFile", "a response has either a body, or a bodyFile")
+			}
+
+			path := r.BodyFile
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+
+			files = append(files, path)
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				line := item.lineOf(fmt.Sprintf("responses.%d.bodyFile", i))
+				if len(f.Responses) == 1 {
+					line = item.lineOf("bodyFile")
+				}
+				return nil, files, &FixtureError{Line: line, Err: err}
+			}
+
+			body = string(b)
+			isJSON = strings.ToLower(filepath.Ext(path)) == ".json"
+		}
+
+		if isJSON && resp.Headers.Get("Content-Type") == "" {
+			if resp.Headers == nil {
+				resp.Headers = make(http.Header)
+			}
+			resp.Headers.Set("Content-Type", "application/json")
+		}
+
+		resp.Body = body
+		m.Responses = append(m.Responses, resp)
+	}
+
+	// A single response is served as the plain fields, as if written in Go
+	if len(m.Responses) == 1 && m.Responses[0].Repeat == 0 {
+		r := m.Responses[0]
+		m.RespHTTPCode, m.RespHeaders, m.RespBody = r.HTTPCode, r.Headers, r.Body
+		m.Responses = nil
+	}
+
+	if _, err := compileMock(m); err != nil {
+		return fail("", err.Error())
+	}
+
+	return m, files, nil
+}
+
+// The line of a decoding error: the field if it is known, or else the mock
+func fixtureErrorLine(item *fixtureNode, err error) int {
+
+	var typeErr *json.UnmarshalTypeError
+	var keyErr *fixtureKeyError
+
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return item.lineOf(typeErr.Field)
+
+	case errors.As(err, &keyErr):
+		if line := item.lineOfKey(keyErr.key); line > 0 {
+			return line
+		}
+
+	default:
+		if match := unknownFieldError.FindStringSubmatch(err.Error()); match != nil {
+			if line := item.lineOfKey(match[1]); line > 0 {
+				return line
+			}
+		}
+	}
+
+	return item.line
+}
+
+// A body is a string, or any other JSON value. Returns whether it is JSON
+func fixtureBody(raw json.RawMessage) (string, bool) {
+
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", false
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s, false
+	}
+
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return string(raw), true
+	}
+
+	return buf.String(), true
+}
+
+func canonicalHeader(values fixtureValues) http.Header {
+
+	h := make(http.Header, len(values))
+	for k, v := range values {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+
+	return h
+}
+
+// What identifies a version of the fixtures: the files in the directory,
+// and the size and modification time of every file read
+func fixtureStamp(path string, files []string) string {
+
+	var names []string
+
+	if infos, err := ioutil.ReadDir(path); err == nil {
+		for _, info := range infos {
+			if !info.IsDir() && isFixtureFile(info.Name()) {
+				names = append(names, filepath.Join(path, info.Name()))
+			}
+		}
+	}
+
+	names = append(names, files...)
+	sort.Strings(names)
+
+	var b strings.Builder
+
+	for _, name := range names {
+		b.WriteString(name)
+		if info, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&b, " %d %d", info.Size(), info.ModTime().UnixNano())
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
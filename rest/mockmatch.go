@@ -0,0 +1,530 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// BodyMatch is how the ReqBody of a Mock is compared to the request body
+type BodyMatch int
+
+const (
+	// BodyExact compares byte by byte
+	BodyExact BodyMatch = iota
+
+	// BodyJSON compares JSON values, ignoring key order and spacing
+	BodyJSON
+
+	// BodyXML compares XML documents, ignoring attribute order and spacing
+	// between elements
+	BodyXML
+)
+
+// mockEntry is a Mock added to a MockServer, with the state the server keeps
+// for it. Mocks belong to the caller, and may be added to many servers, so
+// they are never modified.
+type mockEntry struct {
+	*Mock
+	headersRegexp map[string]*regexp.Regexp
+	urlRegexp     *regexp.Regexp
+	templates     []*template.Template // One per response, if RespTemplate
+	seq           uint64               // Order in which it was added, newer wins ties
+	calls         int                  // Requests served. Server lock must be held
+}
+
+// Compiles the regular expressions and templates of the mock
+func compileMock(m *Mock) (*mockEntry, error) {
+
+	e := &mockEntry{Mock: m}
+
+	var err error
+
+	switch {
+	case m.URLPattern != "":
+		e.urlRegexp, err = patternRegexp(m.URLPattern)
+	case m.URLRegexp != "":
+		e.urlRegexp, err = regexp.Compile(m.URLRegexp)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if m.RespTemplate {
+
+		bodies := []string{m.RespBody}
+		if len(m.Responses) > 0 {
+			bodies = bodies[:0]
+			for _, r := range m.Responses {
+				bodies = append(bodies, r.Body)
+			}
+		}
+
+		for _, body := range bodies {
+
+			tmpl, err := template.New(m.mockURL()).Funcs(mockTemplateFuncs).Parse(body)
+			if err != nil {
+				return nil, err
+			}
+
+			e.templates = append(e.templates, tmpl)
+		}
+	}
+
+	for k, expr := range m.ReqHeadersRegexp {
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.headersRegexp == nil {
+			e.headersRegexp = make(map[string]*regexp.Regexp)
+		}
+
+		e.headersRegexp[k] = re
+	}
+
+	return e, nil
+}
+
+func (m *mockEntry) matchHeaders(h http.Header) bool {
+
+	for k, values := range m.ReqHeaders {
+		for _, v := range values {
+			if !containsString(h[http.CanonicalHeaderKey(k)], v) {
+				return false
+			}
+		}
+	}
+
+	for _, k := range m.ReqHeadersPresent {
+		if _, ok := h[http.CanonicalHeaderKey(k)]; !ok {
+			return false
+		}
+	}
+
+	for k, re := range m.headersRegexp {
+		if !re.MatchString(h.Get(k)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Mock) matchBody(body []byte) bool {
+
+	if m.ReqBodyFunc != nil {
+		return m.ReqBodyFunc(body)
+	}
+
+	if m.ReqBody == "" {
+		return true
+	}
+
+	switch m.ReqBodyMatch {
+	case BodyJSON:
+		return jsonEqual([]byte(m.ReqBody), body)
+	case BodyXML:
+		return xmlEqual([]byte(m.ReqBody), body)
+	default:
+		return m.ReqBody == string(body)
+	}
+}
+
+// Whether the mock is found by its exact URL
+func (m *Mock) byURL() bool {
+	return m.URLPattern == "" && m.URLRegexp == "" && !m.IgnoreQuery
+}
+
+// Matches every request to its method and URL, always. Only one of these is
+// kept per method and URL, as a map would
+func (m *Mock) unconditional() bool {
+	return len(m.ReqQuery) == 0 && len(m.ReqHeaders) == 0 && len(m.ReqHeadersPresent) == 0 &&
+		len(m.ReqHeadersRegexp) == 0 && m.ReqBody == "" && m.ReqBodyFunc == nil &&
+		m.Times == 0 && m.Scenario == ""
+}
+
+// The URL of the mock, whichever kind it is
+func (m *Mock) mockURL() string {
+
+	switch {
+	case m.URLPattern != "":
+		return m.URLPattern
+	case m.URLRegexp != "":
+		return m.URLRegexp
+	}
+
+	return m.URL
+}
+
+// Matches URLs not found by the exact URL. Returns the path variables.
+func (m *mockEntry) matchURL(u *url.URL) (map[string]string, bool) {
+
+	noQuery := *u
+	noQuery.RawQuery = ""
+	noQuery.ForceQuery = false
+	noQuery.Fragment = ""
+
+	if m.urlRegexp == nil {
+		if !m.IgnoreQuery {
+			return nil, false
+		}
+
+		mockURL, err := url.Parse(m.URL)
+		if err != nil {
+			return nil, false
+		}
+
+		mockURL.RawQuery = ""
+		mockURL.Fragment = ""
+
+		return nil, mockURL.String() == noQuery.String()
+	}
+
+	s := noQuery.String()
+	if strings.HasPrefix(m.URLPattern, "/") {
+		s = u.EscapedPath()
+	}
+
+	match := m.urlRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return nil, false
+	}
+
+	vars := make(map[string]string)
+	for i, name := range m.urlRegexp.SubexpNames() {
+		if name != "" {
+			vars[name], _ = url.PathUnescape(match[i])
+		}
+	}
+
+	return vars, true
+}
+
+// Every param in ReqQuery must be in the request, with the same values
+func (m *Mock) matchQuery(query url.Values) bool {
+
+	for k, values := range m.ReqQuery {
+		for _, v := range values {
+			if !containsString(query[k], v) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// A regular expression for a URL template.
+// {name} is a path variable, * matches within a segment, ** across them.
+func patternRegexp(pattern string) (*regexp.Regexp, error) {
+
+	var expr strings.Builder
+	expr.WriteString("^")
+
+	for i := 0; i < len(pattern); {
+
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i += 2
+
+		case pattern[i] == '*':
+			expr.WriteString("[^/]*")
+			i++
+
+		case pattern[i] == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return nil, errors.New("Unclosed path variable in " + pattern)
+			}
+			expr.WriteString("(?P<" + pattern[i+1:i+end] + ">[^/]+)")
+			i += end + 1
+
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			i++
+		}
+	}
+
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
+// The response served on a call, counting from 0, and its index
+func (m *Mock) response(call int) (MockResponse, int) {
+
+	if len(m.Responses) == 0 {
+		return MockResponse{HTTPCode: m.RespHTTPCode, Headers: m.RespHeaders, Body: m.RespBody, Fault: m.Fault}, 0
+	}
+
+	for i, r := range m.Responses {
+
+		if r.Fault == nil {
+			r.Fault = m.Fault
+		}
+
+		repeat := r.Repeat
+		if repeat <= 0 {
+			repeat = 1
+		}
+
+		if call < repeat {
+			return r, i
+		}
+
+		call -= repeat
+	}
+
+	last := len(m.Responses) - 1
+
+	r := m.Responses[last]
+	if r.Fault == nil {
+		r.Fault = m.Fault
+	}
+
+	return r, last
+}
+
+// The body of the i response, rendering its template if there's one
+func (m *mockEntry) render(i int, body string, data MockTemplateData) ([]byte, error) {
+
+	if i >= len(m.templates) {
+		return []byte(body), nil
+	}
+
+	var buf bytes.Buffer
+	if err := m.templates[i].Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// MockTemplateData is the request data response templates are rendered
+// with, as in
+//
+//	{"id": "{{.Vars.id}}", "page": "{{.Query.Get "page"}}", "at": {{now.Unix}}}
+//
+// Besides the text/template builtins, templates have the functions now,
+// returning the time.Time, and json, encoding a value as JSON.
+type MockTemplateData struct {
+	Method string
+
+	// Original URL of the request, not the one of the MockServer
+	URL *url.URL
+
+	// Path variables captured by URLPattern or URLRegexp
+	Vars map[string]string
+
+	Query   url.Values
+	Headers http.Header
+
+	// Request body, as text
+	Body string
+
+	// Request body decoded as JSON, as in {{.JSON.user.name}}. Nil if it is
+	// not JSON
+	JSON interface{}
+}
+
+var mockTemplateFuncs = template.FuncMap{
+	"now": time.Now,
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func newMockTemplateData(req *http.Request, reqURL *url.URL, body []byte, vars map[string]string) MockTemplateData {
+
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	header := req.Header.Clone()
+	header.Del("X-Original-URL")
+
+	data := MockTemplateData{
+		Method:  req.Method,
+		URL:     reqURL,
+		Vars:    vars,
+		Query:   reqURL.Query(),
+		Headers: header,
+		Body:    string(body),
+	}
+
+	if json.Unmarshal(body, &data.JSON) != nil {
+		data.JSON = nil
+	}
+
+	return data
+}
+
+type mockVarsKey struct{}
+
+// MockVars returns the path variables of a request served by a Mock Handler.
+func MockVars(req *http.Request) map[string]string {
+
+	vars, _ := req.Context().Value(mockVarsKey{}).(map[string]string)
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	return vars
+}
+
+// Calls the Handler of the mock, with the original request.
+// Returns the response it writes, to be served with the Fault of the mock.
+func (m *Mock) handle(req *http.Request, reqURL *url.URL, body []byte, vars map[string]string) (MockResponse, []byte) {
+
+	hreq := req.Clone(context.WithValue(req.Context(), mockVarsKey{}, vars))
+	hreq.URL = reqURL
+	hreq.Host = reqURL.Host
+	hreq.Header.Del("X-Original-URL")
+	hreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	recorder := httptest.NewRecorder()
+	m.Handler(recorder, hreq)
+
+	return MockResponse{HTTPCode: recorder.Code, Headers: recorder.Header(), Fault: m.Fault}, recorder.Body.Bytes()
+}
+
+// The number of request conditions. The more, the more specific the mock.
+// Exact URLs come first, then URLs ignoring the query, templates and regexps.
+func (m *mockEntry) specificity() int {
+
+	var score int
+
+	switch {
+	case m.byURL():
+		score = 3000
+	case m.IgnoreQuery && m.urlRegexp == nil:
+		score = 2000
+	case m.URLPattern != "":
+		score = 1000
+	}
+
+	score += len(m.ReqHeadersPresent) + len(m.ReqHeadersRegexp)
+
+	for _, values := range m.ReqQuery {
+		score += len(values)
+	}
+
+	for _, values := range m.ReqHeaders {
+		score += len(values)
+	}
+
+	if m.ReqBody != "" || m.ReqBodyFunc != nil {
+		score++
+	}
+
+	return score
+}
+
+func containsString(sarray []string, s string) bool {
+
+	for _, v := range sarray {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jsonEqual(a []byte, b []byte) bool {
+
+	var va, vb interface{}
+
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
+
+// An XML element, with its attributes sorted, so documents can be compared
+type xmlNode struct {
+	Name     xml.Name
+	Attrs    []xml.Attr
+	Text     string
+	Children []*xmlNode
+}
+
+func xmlEqual(a []byte, b []byte) bool {
+
+	na, err := parseXMLNode(a)
+	if err != nil {
+		return false
+	}
+
+	nb, err := parseXMLNode(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(na, nb)
+}
+
+func parseXMLNode(b []byte) (*xmlNode, error) {
+
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+
+	for {
+
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parent := stack[len(stack)-1]
+
+		switch t := token.(type) {
+
+		case xml.StartElement:
+			attrs := append([]xml.Attr(nil), t.Attr...)
+			sort.Slice(attrs, func(i, j int) bool {
+				if attrs[i].Name.Space != attrs[j].Name.Space {
+					return attrs[i].Name.Space < attrs[j].Name.Space
+				}
+				return attrs[i].Name.Local < attrs[j].Name.Local
+			})
+
+			node := &xmlNode{Name: t.Name, Attrs: attrs}
+			parent.Children = append(parent.Children, node)
+			stack = append(stack, node)
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			parent.Text += strings.TrimSpace(string(t))
+		}
+	}
+
+	return root, nil
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -12,16 +13,17 @@ import (
 	"sync"
 )
 
+// MOCK_NOT_FOUND_ERROR is the first line of the body of unmatched requests.
+// The rest reports the closest mocks, and how they differ.
 const MOCK_NOT_FOUND_ERROR string = "MockUp nil!"
 
+// Set by the -mock flag, or by StartMockupServer
 var mockUpEnv bool
-var mockMap = make(map[string]*Mock)
-var mockDbMutex sync.RWMutex
+var mockEnvMtx sync.RWMutex
 
-var mockServer *httptest.Server
-var mux *http.ServeMux
-
-var mockServerURL *url.URL
+// The MockServer behind the global API. Its registry exists from the start,
+// so mocks may be added before the server is started.
+var globalMock = newMockServer()
 
 // Mock serves the purpose of creating Mockups.
 // All requests will be sent to the mockup server if mockup is activated.
@@ -32,19 +34,47 @@ var mockServerURL *url.URL
 // 	StartMockupServer()
 type Mock struct {
 
-	// Request URL
+	// Request URL. The query params must be the same, in any order
 	URL string
 
+	// Request URL template, instead of URL. Path variables like {id} match
+	// a path segment, * matches within a segment and ** any number of them.
+	// A template starting with / matches just the path.
+	// The query is not part of the match, see ReqQuery
+	URLPattern string
+
+	// Request URL regular expression, instead of URL. Matched against the URL
+	// without query. Named groups are captured as path variables
+	URLRegexp string
+
+	// Query params the request must have, with these values. Others are allowed
+	ReqQuery url.Values
+
+	// With URL, compare only the path, and the params in ReqQuery
+	IgnoreQuery bool
+
 	// Request HTTP Method (GET, POST, PUT, PATCH, HEAD, DELETE, OPTIONS)
 	// As a good practice use the constants in http package (http.MethodGet, etc.)
 	HTTPMethod string
 
-	// Request array Headers
+	// Request array Headers. Each one must be in the request, with these values
 	ReqHeaders http.Header
 
-	// Request Body, used with POST, PUT & PATCH
+	// Request Headers that must be in the request, with any value
+	ReqHeadersPresent []string
+
+	// Request Headers whose value must match a regular expression
+	ReqHeadersRegexp map[string]string
+
+	// Request Body, used with POST, PUT & PATCH. Empty means any body
 	ReqBody string
 
+	// How ReqBody is compared to the request body. Default is BodyExact
+	ReqBodyMatch BodyMatch
+
+	// Custom predicate on the request body, instead of ReqBody
+	ReqBodyFunc func(body []byte) bool
+
 	// Response HTTP Code
 	RespHTTPCode int
 
@@ -53,66 +83,516 @@ type Mock struct {
 
 	// Response Body
 	RespBody string
+
+	// Sequence of Responses, instead of RespHTTPCode, RespHeaders and RespBody.
+	// Once it is over, the last one keeps being served
+	Responses []MockResponse
+
+	// RespBody, or the Responses bodies, are a text/template. Rendered with
+	// the request data, as in {{.Vars.id}} or {{.JSON.name}}. See
+	// MockTemplateData
+	RespTemplate bool
+
+	// Computes the response from the request, instead of the response fields.
+	// The request has the original URL, and MockVars returns its path
+	// variables. Faults are injected on the response it writes
+	Handler http.HandlerFunc
+
+	// Faults and latency injected when serving the mock, or its Responses
+	// that don't set their own. Nil means none
+	Fault *MockFault
+
+	// Number of requests the mock is served for. After them, it stops
+	// matching. Zero means no limit
+	Times int
+
+	// Scenario the mock belongs to, whose state starts as ScenarioStarted.
+	// Mocks of a Scenario move it from one state to the next, as in WireMock
+	Scenario string
+
+	// State the Scenario must be in for the mock to match. Empty means any
+	RequiredState string
+
+	// State the Scenario moves to once the mock is served. Empty means no change
+	NewState string
+}
+
+// MockResponse is one of the Responses of a Mock sequence
+type MockResponse struct {
+	HTTPCode int
+	Headers  http.Header
+	Body     string
+
+	// Times this Response is served, before the next one. Zero means once
+	Repeat int
+
+	// Faults injected when serving this Response. Nil means those of the Mock
+	Fault *MockFault
+}
+
+// ScenarioStarted is the state every Scenario starts in
+const ScenarioStarted = "Started"
+
+// MockT is the part of testing.TB used by MockServer.
+// *testing.T and *testing.B implement it.
+type MockT interface {
+	Cleanup(func())
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// MockServer is a mockup server with its own registry of Mocks, so tests
+// running in parallel don't stomp on each other.
+//
+// RequestBuilders are attached to it with their MockServer field. Those that
+// don't set a Cache use one of the MockServer, so cached Responses are not
+// shared with other tests either.
+type MockServer struct {
+
+	// Fail the test if a mock was never called, when it ends.
+	// Only for MockServers created with a MockT
+	FailOnUnused bool
+
+	// Fail the test, when it ends, for every request no mock matched, with
+	// the report of the closest mocks. Only for MockServers created with a MockT
+	Strict bool
+
+	mtx      sync.RWMutex
+	mocks    map[string][]*mockEntry // By method and normalized URL
+	patterns []*mockEntry            // Mocks that are not matched by URL
+	states   map[string]string       // Scenario states
+	seq      uint64
+	requests []MockRequest // Received, in order
+	misses   []string      // Reports of unmatched requests, in Strict mode
+	cassette *Cassette
+	watchers []func() // Stop watching fixtures
+	server   *httptest.Server
+	url      *url.URL
+	cache    ResourceCache
+	t        MockT
+}
+
+// NewMockServer starts a MockServer. If t is not nil, the server is closed
+// when the test ends, otherwise Close must be called.
+func NewMockServer(t MockT) *MockServer {
+
+	ms := newMockServer()
+	ms.t = t
+	ms.start()
+
+	if t != nil {
+		t.Cleanup(func() {
+			if ms.FailOnUnused {
+				ms.AssertAllUsed(t)
+			}
+			ms.Close()
+
+			// Once closed, so there are no more requests
+			if ms.Strict {
+				ms.reportMisses(t)
+			}
+		})
+	}
+
+	return ms
+}
+
+func newMockServer() *MockServer {
+	return &MockServer{mocks: make(map[string][]*mockEntry), states: make(map[string]string)}
+}
+
+func (ms *MockServer) start() {
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if ms.server != nil {
+		return
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(ms.mockupHandler))
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+
+	ms.server = server
+	ms.url = serverURL
+}
+
+// Closes the server, keeping the mocks
+func (ms *MockServer) stop() {
+
+	ms.mtx.Lock()
+	server := ms.server
+	ms.server = nil
+	ms.url = nil
+	ms.mtx.Unlock()
+
+	if server != nil {
+		server.Close()
+	}
+}
+
+func (ms *MockServer) started() bool {
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+	return ms.server != nil
+}
+
+// URL of the server. Empty if closed.
+func (ms *MockServer) URL() string {
+
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	if ms.server == nil {
+		return ""
+	}
+
+	return ms.server.URL
+}
+
+// Close shuts the server down, stops watching fixtures, saves its Cassette,
+// and closes its cache.
+func (ms *MockServer) Close() error {
+
+	ms.stop()
+
+	ms.mtx.Lock()
+	cassette := ms.cassette
+	watchers := ms.watchers
+	ms.watchers = nil
+	ms.mtx.Unlock()
+
+	for _, stop := range watchers {
+		stop()
+	}
+
+	var err error
+	if cassette != nil {
+		err = cassette.Save()
+	}
+
+	if cerr := ms.cache.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// AddMockups adds mocks to the server. When many mocks match a request, the
+// most specific one wins, and among those, the last one added. A mock with
+// just a method and URL replaces the one already added for them.
+func (ms *MockServer) AddMockups(mocks ...*Mock) error {
+	for _, m := range mocks {
+		normalizedUrl, err := getNormalizedUrl(m.URL)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error parsing mock with url=%s. Cause: %s", m.URL, err.Error()))
+		}
+		e, err := compileMock(m)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error parsing mock with url=%s. Cause: %s", m.mockURL(), err.Error()))
+		}
+		ms.mtx.Lock()
+		ms.insert(e, normalizedUrl)
+		ms.mtx.Unlock()
+	}
+	return nil
+}
+
+// Lock must be held
+func (ms *MockServer) insert(e *mockEntry, normalizedUrl string) {
+
+	ms.seq++
+	e.seq = ms.seq
+
+	if e.byURL() {
+		key := e.HTTPMethod + " " + normalizedUrl
+		if e.unconditional() {
+			ms.mocks[key] = removeUnconditional(ms.mocks[key])
+		}
+		ms.mocks[key] = append(ms.mocks[key], e)
+	} else {
+		ms.patterns = append(ms.patterns, e)
+	}
+}
+
+// Removes the old mocks and adds the new ones at once, so requests find
+// either of them. If a new mock is not valid, nothing changes.
+func (ms *MockServer) replaceMockups(old []*Mock, mocks []*Mock) error {
+
+	urls := make([]string, len(mocks))
+	entries := make([]*mockEntry, len(mocks))
+
+	for i, m := range mocks {
+		normalizedUrl, err := getNormalizedUrl(m.URL)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error parsing mock with url=%s. Cause: %s", m.URL, err.Error()))
+		}
+		e, err := compileMock(m)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error parsing mock with url=%s. Cause: %s", m.mockURL(), err.Error()))
+		}
+		urls[i] = normalizedUrl
+		entries[i] = e
+	}
+
+	removed := make(map[*Mock]bool, len(old))
+	for _, m := range old {
+		removed[m] = true
+	}
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	if len(removed) > 0 {
+		for key, byURL := range ms.mocks {
+			ms.mocks[key] = removeMocks(byURL, removed)
+		}
+		ms.patterns = removeMocks(ms.patterns, removed)
+	}
+
+	for i, e := range entries {
+		ms.insert(e, urls[i])
+	}
+
+	return nil
+}
+
+func removeMocks(entries []*mockEntry, removed map[*Mock]bool) []*mockEntry {
+
+	var kept []*mockEntry
+	for _, e := range entries {
+		if !removed[e.Mock] {
+			kept = append(kept, e)
+		}
+	}
+
+	return kept
+}
+
+func removeUnconditional(entries []*mockEntry) []*mockEntry {
+
+	var kept []*mockEntry
+	for _, e := range entries {
+		if !e.unconditional() {
+			kept = append(kept, e)
+		}
+	}
+
+	return kept
+}
+
+// FlushMockups removes every mock from the server, and the requests received.
+func (ms *MockServer) FlushMockups() {
+	ms.mtx.Lock()
+	ms.mocks = make(map[string][]*mockEntry)
+	ms.patterns = nil
+	ms.states = make(map[string]string)
+	ms.requests = nil
+	ms.mtx.Unlock()
+}
+
+// ScenarioState returns the current state of a Scenario.
+func (ms *MockServer) ScenarioState(scenario string) string {
+
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	return ms.scenarioState(scenario)
+}
+
+// SetScenarioState moves a Scenario to a state.
+func (ms *MockServer) SetScenarioState(scenario string, state string) {
+	ms.mtx.Lock()
+	ms.states[scenario] = state
+	ms.mtx.Unlock()
+}
+
+// ResetScenarios moves every Scenario back to ScenarioStarted, and resets the
+// calls count of the mocks, so sequences start over.
+func (ms *MockServer) ResetScenarios() {
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	ms.states = make(map[string]string)
+
+	for _, mocks := range ms.mocks {
+		for _, m := range mocks {
+			m.calls = 0
+		}
+	}
+
+	for _, m := range ms.patterns {
+		m.calls = 0
+	}
+}
+
+// Sorts mocks in the order they were added
+func sortMocks(mocks []*mockEntry) {
+	sort.Slice(mocks, func(i, j int) bool { return mocks[i].seq < mocks[j].seq })
+}
+
+// Lock must be held
+func (ms *MockServer) scenarioState(scenario string) string {
+
+	if state, ok := ms.states[scenario]; ok {
+		return state
+	}
+
+	return ScenarioStarted
+}
+
+// Whether the mock may still be served: within its Times, and in its state
+// Lock must be held
+func (ms *MockServer) available(m *mockEntry) bool {
+
+	if m.Times > 0 && m.calls >= m.Times {
+		return false
+	}
+
+	return m.Scenario == "" || m.RequiredState == "" || ms.scenarioState(m.Scenario) == m.RequiredState
+}
+
+// The most specific mock matching the request, its path variables, and which
+// call to it this is, counting from 0. The mock is counted as served, and the
+// request recorded along, so that both happen in the same order. If none
+// matches and diagnose is set, the miss report is recorded and returned.
+func (ms *MockServer) match(key string, reqURL *url.URL, req *http.Request, body []byte, diagnose bool) (*mockEntry, map[string]string, int, string) {
+
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+
+	var best *mockEntry
+	var bestVars map[string]string
+	bestScore := -1
+
+	try := func(m *mockEntry, vars map[string]string) {
+
+		if !ms.available(m) || !m.matchQuery(reqURL.Query()) || !m.matchHeaders(req.Header) || !m.matchBody(body) {
+			return
+		}
+
+		if score := m.specificity(); score > bestScore || (score == bestScore && m.seq > best.seq) {
+			best, bestVars, bestScore = m, vars, score
+		}
+	}
+
+	for _, m := range ms.mocks[key] {
+		try(m, nil)
+	}
+
+	for _, m := range ms.patterns {
+		if m.HTTPMethod != req.Method {
+			continue
+		}
+		if vars, ok := m.matchURL(reqURL); ok {
+			try(m, vars)
+		}
+	}
+
+	if best == nil {
+		var miss string
+		if diagnose {
+			miss = ms.missReport(key, reqURL, req, body)
+		}
+
+		ms.record(req, body, nil, miss)
+		return nil, nil, 0, miss
+	}
+
+	call := best.calls
+	best.calls++
+
+	if best.Scenario != "" && best.NewState != "" {
+		ms.states[best.Scenario] = best.NewState
+	}
+
+	ms.record(req, body, best.Mock, "")
+	return best, bestVars, call, ""
+}
+
+// Points the URL to the server. The original URL is kept, as the cache URL.
+func (ms *MockServer) rewrite(reqURL string) (string, string, error) {
+
+	cacheURL := reqURL
+
+	rURL, err := url.Parse(reqURL)
+	if err != nil {
+		return reqURL, cacheURL, err
+	}
+
+	ms.mtx.RLock()
+	serverURL := ms.url
+	ms.mtx.RUnlock()
+
+	if serverURL == nil {
+		return reqURL, cacheURL, errors.New("MockServer is closed")
+	}
+
+	rURL.Scheme = serverURL.Scheme
+	rURL.Host = serverURL.Host
+
+	return rURL.String(), cacheURL, nil
 }
 
 // StartMockupServer sets the enviroment to send all client requests
 // to the mockup server.
 func StartMockupServer() {
 
-	mockUpEnv = true
+	mockEnvMtx.Lock()
+	defer mockEnvMtx.Unlock()
 
-	if mockServer == nil {
-		startMockupServ()
-	}
+	mockUpEnv = true
+	globalMock.start()
 }
 
 // StopMockupServer stop sending requests to the mockup server
 func StopMockupServer() {
 
-	mockUpEnv = false
-	mockServer.Close()
+	mockEnvMtx.Lock()
+	defer mockEnvMtx.Unlock()
 
-	mockServer = nil
-	mockServerURL = nil
-	mux = nil
+	mockUpEnv = false
+	globalMock.stop()
 }
 
-func startMockupServ() {
+// The global MockServer, if the mockup environment is on.
+// It is started on first use, as the -mock flag is parsed after init.
+func globalMockServer() *MockServer {
 
-	if mockUpEnv {
-		mux = http.NewServeMux()
-		mockServer = httptest.NewServer(mux)
-		mux.HandleFunc("/", mockupHandler)
-		mockDbMutex = *new(sync.RWMutex)
+	mockEnvMtx.RLock()
+	env := mockUpEnv
+	mockEnvMtx.RUnlock()
 
-		var err error
-		if mockServerURL, err = url.Parse(mockServer.URL); err != nil {
-			panic(err)
-		}
+	if !env {
+		return nil
+	}
 
+	if !globalMock.started() {
+		mockEnvMtx.Lock()
+		if mockUpEnv {
+			globalMock.start()
+		}
+		mockEnvMtx.Unlock()
 	}
+
+	return globalMock
 }
 
+// The flag is parsed by the program, or by go test. Parsing it here would
+// break the flags of any other package.
 func init() {
 	flag.BoolVar(&mockUpEnv, "mock", false,
 		"Use 'mock' flag to tell package rest that you would like to use mockups.")
-
-	flag.Parse()
-	startMockupServ()
 }
 
 // AddMockups ...
 func AddMockups(mocks ...*Mock) error {
-	for _, m := range mocks {
-		normalizedUrl, err := getNormalizedUrl(m.URL)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Error parsing mock with url=%s. Cause: %s", m.URL, err.Error()))
-		}
-		mockDbMutex.Lock()
-		mockMap[m.HTTPMethod+" "+normalizedUrl] = m
-		mockDbMutex.Unlock()
-	}
-	return nil
+	return globalMock.AddMockups(mocks...)
 }
 
 //check if a string url is valid and also sort query params in order to make the url easy to compare
@@ -147,33 +627,86 @@ func getNormalizedUrl(urlStr string) (string, error) {
 
 // FlushMockups ...
 func FlushMockups() {
-	mockDbMutex.Lock()
-	mockMap = make(map[string]*Mock)
-	mockDbMutex.Unlock()
+	globalMock.FlushMockups()
 }
 
-func mockupHandler(writer http.ResponseWriter, req *http.Request) {
+func (ms *MockServer) mockupHandler(writer http.ResponseWriter, req *http.Request) {
+
+	originalURL := req.Header.Get("X-Original-URL")
+	normalizedUrl, err := getNormalizedUrl(originalURL)
+
+	var reqURL *url.URL
+	if err == nil {
+		reqURL, err = url.Parse(originalURL)
+	}
 
-	normalizedUrl, err := getNormalizedUrl(req.Header.Get("X-Original-URL"))
+	var body []byte
+	if err == nil {
+		body, err = ioutil.ReadAll(req.Body)
+	}
 
 	if err == nil {
-		mockDbMutex.RLock()
-		m := mockMap[req.Method+" "+normalizedUrl]
-		mockDbMutex.RUnlock()
+		ms.mtx.RLock()
+		cassette := ms.cassette
+		ms.mtx.RUnlock()
+
+		if cassette != nil && cassette.Mode == CassetteRecord {
+			ms.mtx.Lock()
+			ms.record(req, body, nil, "")
+			ms.mtx.Unlock()
+
+			cassette.proxy(writer, req, reqURL, body)
+			return
+		}
+
+		key := req.Method + " " + normalizedUrl
+
+		diagnose := cassette == nil || cassette.Mode != CassetteReplayOrRecord
+		m, vars, call, miss := ms.match(key, reqURL, req, body, diagnose)
+
+		if m != nil && m.Handler != nil {
+			resp, respBody := m.handle(req, reqURL, body, vars)
+			resp.Fault.serve(writer, req, resp, respBody)
+			return
+		}
+
 		if m != nil {
-			// Add headers
-			for k, v := range m.RespHeaders {
-				for _, vv := range v {
-					writer.Header().Add(k, vv)
-				}
+			resp, i := m.response(call)
+
+			respBody, err := m.render(i, resp.Body, newMockTemplateData(req, reqURL, body, vars))
+			if err != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+				writer.Write([]byte(err.Error()))
+				return
 			}
 
-			writer.WriteHeader(m.RespHTTPCode)
-			writer.Write([]byte(m.RespBody))
+			resp.Fault.serve(writer, req, resp, respBody)
 			return
 		}
+
+		// New interactions are replayed from then on
+		if cassette != nil && cassette.Mode == CassetteReplayOrRecord {
+			if in := cassette.proxy(writer, req, reqURL, body); in != nil {
+				cassette.mtx.Lock()
+				m := cassette.mock(*in)
+				cassette.mtx.Unlock()
+				ms.AddMockups(m)
+			}
+			return
+		}
+
+		// Reported when the test ends, as the test may be over by now
+		if ms.Strict {
+			ms.mtx.Lock()
+			ms.misses = append(ms.misses, miss)
+			ms.mtx.Unlock()
+		}
+
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte(miss))
+		return
 	}
 
 	writer.WriteHeader(http.StatusBadRequest)
-	writer.Write([]byte(MOCK_NOT_FOUND_ERROR))
+	writer.Write([]byte(MOCK_NOT_FOUND_ERROR + "\nInvalid request: " + err.Error() + "\n"))
 }
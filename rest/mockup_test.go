@@ -1,8 +1,21 @@
 package rest
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMockup(t *testing.T) {
@@ -25,9 +38,1047 @@ func TestMockup(t *testing.T) {
 
 	AddMockups(&mock)
 
-	v := Get(myURL)
+	// The mock only matches requests with its headers
+	builder := RequestBuilder{Headers: myHeaders}
+
+	v := builder.Get(myURL)
 	if v.String() != "foo" {
 		t.Fatal("Mockup Fail!")
 	}
 
 }
+
+func TestMockServerParallel(t *testing.T) {
+
+	for _, body := range []string{"foo", "bar"} {
+
+		body := body
+
+		t.Run(body, func(t *testing.T) {
+			t.Parallel()
+
+			ms := NewMockServer(t)
+			ms.AddMockups(&Mock{
+				URL:          "http://mytest.com/parallel",
+				HTTPMethod:   http.MethodGet,
+				RespHTTPCode: http.StatusOK,
+				RespBody:     body,
+				RespHeaders:  http.Header{"Cache-Control": {"max-age=60"}},
+			})
+
+			builder := RequestBuilder{MockServer: ms}
+
+			for i := 0; i < 2; i++ {
+				if r := builder.Get("http://mytest.com/parallel"); r.String() != body {
+					t.Fatal("Mockup Fail!")
+				}
+			}
+		})
+	}
+
+}
+
+// Shared by servers of parallel tests, which keep their own state for it
+var sharedMock = &Mock{
+	URLPattern:   "http://mytest.com/shared/{id}",
+	HTTPMethod:   http.MethodGet,
+	RespHTTPCode: http.StatusOK,
+	RespTemplate: true,
+	RespBody:     "{{.Vars.id}}",
+	Times:        2,
+}
+
+func TestMockServerSharedMock(t *testing.T) {
+
+	for i := 0; i < 4; i++ {
+
+		id := strconv.Itoa(i)
+
+		t.Run(id, func(t *testing.T) {
+			t.Parallel()
+
+			ms := NewMockServer(t)
+			ms.AddMockups(sharedMock)
+
+			builder := RequestBuilder{MockServer: ms, DisableCache: true}
+
+			for j := 0; j < 2; j++ {
+				if r := builder.Get("http://mytest.com/shared/" + id); r.String() != id {
+					t.Fatal("Shared mock should be served by every server", r.String())
+				}
+			}
+
+			if r := builder.Get("http://mytest.com/shared/" + id); r.StatusCode != http.StatusBadRequest {
+				t.Fatal("Times should be counted per server", r.StatusCode)
+			}
+		})
+	}
+
+}
+
+func TestMockServerClose(t *testing.T) {
+
+	ms := NewMockServer(nil)
+	builder := RequestBuilder{MockServer: ms}
+
+	ms.Close()
+
+	if r := builder.Get("http://mytest.com/foo"); r.Err == nil {
+		t.Fatal("Closed MockServer should fail")
+	}
+
+}
+
+func TestMockHeaderMatch(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	ms.AddMockups(
+		&Mock{
+			URL:          "http://mytest.com/header",
+			HTTPMethod:   http.MethodGet,
+			RespHTTPCode: http.StatusOK,
+			RespBody:     "any",
+		},
+		&Mock{
+			URL:               "http://mytest.com/header",
+			HTTPMethod:        http.MethodGet,
+			ReqHeadersPresent: []string{"X-Token"},
+			RespHTTPCode:      http.StatusOK,
+			RespBody:          "token",
+		},
+		&Mock{
+			URL:              "http://mytest.com/header",
+			HTTPMethod:       http.MethodGet,
+			ReqHeaders:       http.Header{"X-Token": {"admin"}},
+			ReqHeadersRegexp: map[string]string{"X-Tenant": "^t-[0-9]+$"},
+			RespHTTPCode:     http.StatusOK,
+			RespBody:         "admin",
+		},
+	)
+
+	tests := []struct {
+		headers http.Header
+		body    string
+	}{
+		{nil, "any"},
+		{http.Header{"X-Token": {"user"}}, "token"},
+		{http.Header{"X-Token": {"admin"}}, "token"},
+		{http.Header{"X-Token": {"admin"}, "X-Tenant": {"t-12"}}, "admin"},
+		{http.Header{"X-Token": {"admin"}, "X-Tenant": {"t-xx"}}, "token"},
+	}
+
+	for _, tt := range tests {
+		builder := RequestBuilder{MockServer: ms, Headers: tt.headers, DisableCache: true}
+		if r := builder.Get("http://mytest.com/header"); r.String() != tt.body {
+			t.Fatal("Expected", tt.body, "got", r.String())
+		}
+	}
+
+}
+
+func TestMockBodyMatch(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	ms.AddMockups(
+		&Mock{
+			URL:          "http://mytest.com/body",
+			HTTPMethod:   http.MethodPost,
+			ReqBody:      `{"name": "Hernan", "id": 1}`,
+			ReqBodyMatch: BodyJSON,
+			RespHTTPCode: http.StatusCreated,
+			RespBody:     "json",
+		},
+		&Mock{
+			URL:          "http://mytest.com/body",
+			HTTPMethod:   http.MethodPost,
+			ReqBody:      `<User name="Juan" id="2"><Age>30</Age></User>`,
+			ReqBodyMatch: BodyXML,
+			RespHTTPCode: http.StatusCreated,
+			RespBody:     "xml",
+		},
+		&Mock{
+			URL:          "http://mytest.com/body",
+			HTTPMethod:   http.MethodPost,
+			ReqBodyFunc:  func(b []byte) bool { return len(b) > 0 && b[0] == '!' },
+			RespHTTPCode: http.StatusCreated,
+			RespBody:     "func",
+		},
+	)
+
+	builder := RequestBuilder{MockServer: ms, ContentType: BYTES}
+
+	tests := []struct {
+		req  string
+		body string
+	}{
+		{`{"id":1,"name":"Hernan"}`, "json"},
+		{"<User id=\"2\" name=\"Juan\">\n  <Age>30</Age>\n</User>", "xml"},
+		{"!anything", "func"},
+		{`{"id":2,"name":"Hernan"}`, MOCK_NOT_FOUND_ERROR},
+	}
+
+	for _, tt := range tests {
+		if r := builder.Post("http://mytest.com/body", []byte(tt.req)); firstLine(r.String()) != tt.body {
+			t.Fatal("Expected", tt.body, "got", r.String())
+		}
+	}
+
+}
+
+func TestMockURLPatterns(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	ms.AddMockups(
+		&Mock{
+			URLPattern:   "http://mytest.com/items/{id}",
+			HTTPMethod:   http.MethodGet,
+			RespHTTPCode: http.StatusOK,
+			RespBody:     `{"id": "{{.Vars.id}}"}`,
+			RespTemplate: true,
+		},
+		&Mock{
+			URL:          "http://mytest.com/items/42",
+			HTTPMethod:   http.MethodGet,
+			RespHTTPCode: http.StatusOK,
+			RespBody:     "exact",
+		},
+		&Mock{
+			URLPattern:   "/files/**/*.json",
+			HTTPMethod:   http.MethodGet,
+			RespHTTPCode: http.StatusOK,
+			RespBody:     "glob",
+		},
+		&Mock{
+			URLRegexp:    `^http://mytest\.com/users/(?P<user>[a-z]+)/orders$`,
+			HTTPMethod:   http.MethodGet,
+			ReqQuery:     url.Values{"status": {"open"}},
+			RespHTTPCode: http.StatusOK,
+			RespBody:     "{{.Vars.user}}",
+			RespTemplate: true,
+		},
+		&Mock{
+			URL:          "http://mytest.com/search?q=go",
+			HTTPMethod:   http.MethodGet,
+			IgnoreQuery:  true,
+			RespHTTPCode: http.StatusOK,
+			RespBody:     "search",
+		},
+	)
+
+	builder := RequestBuilder{MockServer: ms, DisableCache: true}
+
+	tests := []struct {
+		url  string
+		body string
+	}{
+		{"http://mytest.com/items/7", `{"id": "7"}`},
+		{"http://mytest.com/items/42", "exact"},
+		{"http://mytest.com/items/7/parts", MOCK_NOT_FOUND_ERROR},
+		{"http://other.com/files/a/b/c.json", "glob"},
+		{"http://other.com/files/a/b/c.xml", MOCK_NOT_FOUND_ERROR},
+		{"http://mytest.com/users/juan/orders?status=open&page=2", "juan"},
+		{"http://mytest.com/users/juan/orders?status=closed", MOCK_NOT_FOUND_ERROR},
+		{"http://mytest.com/search?page=3", "search"},
+	}
+
+	for _, tt := range tests {
+		if r := builder.Get(tt.url); firstLine(r.String()) != tt.body {
+			t.Fatal("Expected", tt.body, "for", tt.url, "got", r.String())
+		}
+	}
+
+}
+
+func TestMockSequence(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	ms.AddMockups(&Mock{
+		URL:        "http://mytest.com/retry",
+		HTTPMethod: http.MethodGet,
+		Responses: []MockResponse{
+			{HTTPCode: http.StatusServiceUnavailable, Repeat: 2},
+			{HTTPCode: http.StatusOK, Body: "ok"},
+		},
+	})
+
+	ms.AddMockups(&Mock{
+		URL:          "http://mytest.com/once",
+		HTTPMethod:   http.MethodGet,
+		RespHTTPCode: http.StatusOK,
+		Times:        1,
+	})
+
+	builder := RequestBuilder{MockServer: ms, DisableCache: true}
+
+	for _, code := range []int{503, 503, 200, 200} {
+		if r := builder.Get("http://mytest.com/retry"); r.StatusCode != code {
+			t.Fatal("Expected", code, "got", r.StatusCode)
+		}
+	}
+
+	if builder.Get("http://mytest.com/once").StatusCode != http.StatusOK {
+		t.Fatal("Status != OK (200)")
+	}
+
+	if builder.Get("http://mytest.com/once").StatusCode != http.StatusBadRequest {
+		t.Fatal("Mock should stop matching after Times")
+	}
+
+	ms.ResetScenarios()
+
+	if builder.Get("http://mytest.com/retry").StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Sequence should start over")
+	}
+
+}
+
+func TestMockSequenceRequests(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	const n = 100
+
+	var responses []MockResponse
+	for i := 0; i < n; i++ {
+		responses = append(responses, MockResponse{HTTPCode: http.StatusOK, Body: strconv.Itoa(i)})
+	}
+
+	ms.AddMockups(&Mock{
+		URL:        "http://mytest.com/seq",
+		HTTPMethod: http.MethodGet,
+		Responses:  responses,
+	})
+
+	bodies := make([]string, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			builder := RequestBuilder{
+				MockServer:   ms,
+				DisableCache: true,
+				Headers:      http.Header{"X-Id": {strconv.Itoa(i)}},
+			}
+			bodies[i] = builder.Get("http://mytest.com/seq").String()
+		}(i)
+	}
+	wg.Wait()
+
+	// The k-th request recorded is the one served the k-th response
+	for k, req := range ms.Requests() {
+		id, _ := strconv.Atoi(req.Header.Get("X-Id"))
+		if bodies[id] != strconv.Itoa(k) {
+			t.Fatal("Request", k, "got response", bodies[id])
+		}
+	}
+
+}
+
+func TestMockScenario(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	pending := func(state, next string) *Mock {
+		return &Mock{
+			URL:           "http://mytest.com/job",
+			HTTPMethod:    http.MethodGet,
+			Scenario:      "job",
+			RequiredState: state,
+			NewState:      next,
+			RespHTTPCode:  http.StatusOK,
+			RespBody:      `{"status": "pending"}`,
+		}
+	}
+
+	ms.AddMockups(
+		pending(ScenarioStarted, "second"),
+		pending("second", "done"),
+		&Mock{
+			URL:           "http://mytest.com/job",
+			HTTPMethod:    http.MethodGet,
+			Scenario:      "job",
+			RequiredState: "done",
+			RespHTTPCode:  http.StatusOK,
+			RespBody:      `{"status": "done"}`,
+		},
+	)
+
+	builder := RequestBuilder{MockServer: ms, DisableCache: true}
+
+	for _, status := range []string{"pending", "pending", "done", "done"} {
+		if r := builder.Get("http://mytest.com/job"); r.String() != `{"status": "`+status+`"}` {
+			t.Fatal("Expected", status, "got", r.String())
+		}
+	}
+
+	if ms.ScenarioState("job") != "done" {
+		t.Fatal("Scenario should be done")
+	}
+
+}
+
+func TestMockFaults(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	add := func(path string, fault *MockFault) {
+		ms.AddMockups(&Mock{
+			URL:          "http://mytest.com/fault/" + path,
+			HTTPMethod:   http.MethodGet,
+			RespHTTPCode: http.StatusOK,
+			RespBody:     `{"name": "Hernan"}`,
+			Fault:        fault,
+		})
+	}
+
+	add("slow", &MockFault{Delay: 300 * time.Millisecond})
+	add("slowbody", &MockFault{BodyDelay: 300 * time.Millisecond})
+	add("drip", &MockFault{DripInterval: 5 * time.Millisecond, DripBytes: 4})
+	add("drop", &MockFault{DropConnection: true})
+	add("truncate", &MockFault{TruncateBody: true})
+	add("chunked", &MockFault{MalformedChunked: true})
+
+	// Own pool, as the Timeout is set on the transport
+	builder := RequestBuilder{
+		MockServer:   ms,
+		DisableCache: true,
+		Timeout:      100 * time.Millisecond,
+		CustomPool:   &CustomPool{MaxIdleConnsPerHost: 1},
+	}
+
+	for _, path := range []string{"slow", "drop", "truncate", "chunked"} {
+		if r := builder.Get("http://mytest.com/fault/" + path); r.Err == nil {
+			t.Fatal("Expected an error for", path)
+		}
+	}
+
+	// The Timeout is until the headers are received
+	if r := builder.Get("http://mytest.com/fault/slowbody"); r.Err != nil || r.String() != `{"name": "Hernan"}` {
+		t.Fatal("Body delay should not hit the Timeout")
+	}
+
+	if r := builder.Get("http://mytest.com/fault/drip"); r.Err != nil || r.String() != `{"name": "Hernan"}` {
+		t.Fatal("Drip should send the whole body")
+	}
+
+	// The truncated body is the only Content-Length
+	ms.AddMockups(&Mock{
+		URL:          "http://mytest.com/fault/length",
+		HTTPMethod:   http.MethodGet,
+		RespHTTPCode: http.StatusOK,
+		RespHeaders:  http.Header{"Content-Length": {"5"}},
+		RespBody:     `{"name": "Hernan"}`,
+		Fault:        &MockFault{TruncateBody: true},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, ms.URL(), nil)
+	req.Header.Set("X-Original-URL", "http://mytest.com/fault/length")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Headers should be valid", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := ioutil.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+		t.Fatal("Body should be truncated", err)
+	}
+
+}
+
+func TestMockFaultSequence(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	ms.AddMockups(&Mock{
+		URL:        "http://mytest.com/flaky",
+		HTTPMethod: http.MethodGet,
+		Responses: []MockResponse{
+			{HTTPCode: http.StatusOK, Fault: &MockFault{DropConnection: true}},
+			{HTTPCode: http.StatusOK, Body: "ok"},
+		},
+	})
+
+	builder := RequestBuilder{MockServer: ms, DisableCache: true}
+
+	if builder.Get("http://mytest.com/flaky").Err == nil {
+		t.Fatal("First call should drop the connection")
+	}
+
+	if r := builder.Get("http://mytest.com/flaky"); r.String() != "ok" {
+		t.Fatal("Second call should succeed")
+	}
+
+}
+
+// Records the failures of assertions, instead of failing the test
+type fakeT struct {
+	mtx      sync.Mutex // Errorf may be called by the server
+	errors   []string
+	cleanups []func()
+}
+
+func (t *fakeT) Cleanup(f func()) { t.cleanups = append(t.cleanups, f) }
+func (t *fakeT) Helper()          {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.mtx.Lock()
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+	t.mtx.Unlock()
+}
+
+func (t *fakeT) end() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+func TestMockVerify(t *testing.T) {
+
+	ft := new(fakeT)
+	ms := NewMockServer(ft)
+	ms.FailOnUnused = true
+
+	create := &Mock{
+		URL:          "http://mytest.com/users",
+		HTTPMethod:   http.MethodPost,
+		RespHTTPCode: http.StatusCreated,
+	}
+
+	remove := &Mock{
+		URLPattern:   "http://mytest.com/users/{id}",
+		HTTPMethod:   http.MethodDelete,
+		RespHTTPCode: http.StatusOK,
+	}
+
+	ms.AddMockups(create, remove)
+
+	builder := RequestBuilder{MockServer: ms, Headers: http.Header{"X-Test": {"verify"}}}
+
+	builder.Post("http://mytest.com/users", &User{Id: 9, Name: "Axel"})
+	builder.Post("http://mytest.com/users", &User{Id: 10, Name: "Mateo"})
+	builder.Get("http://mytest.com/unknown")
+
+	requests := ms.Requests()
+	if len(requests) != 3 || requests[2].Mock != nil || requests[2].URL != "http://mytest.com/unknown" {
+		t.Fatal("Every request should be recorded")
+	}
+
+	if requests[0].Header.Get("X-Test") != "verify" || requests[0].Header.Get("X-Original-URL") != "" {
+		t.Fatal("Request headers should be recorded")
+	}
+
+	if !ms.AssertCalled(ft, create, 2) || !ms.AssertNotCalled(ft, remove) {
+		t.Fatal("Assertions should pass", ft.errors)
+	}
+
+	if !ms.AssertCalledWithBody(ft, create, `{"name":"Mateo","id":10}`) {
+		t.Fatal("Called with body should pass", ft.errors)
+	}
+
+	if ms.AssertCalled(ft, create, 1) || ms.AssertCalledWithBody(ft, create, `{"id":11}`) || len(ft.errors) != 2 {
+		t.Fatal("Assertions should fail")
+	}
+
+	ft.end()
+
+	if len(ft.errors) != 3 {
+		t.Fatal("Unused mock should fail the test", ft.errors)
+	}
+
+}
+
+func TestMockReplaceAndReset(t *testing.T) {
+
+	ft := &fakeT{}
+	ms := NewMockServer(ft)
+	ms.FailOnUnused = true
+
+	old := &Mock{URL: "http://mytest.com/users", HTTPMethod: http.MethodGet, RespHTTPCode: http.StatusOK, RespBody: "old"}
+	ms.AddMockups(old)
+
+	replaced := &Mock{URL: "http://mytest.com/users", HTTPMethod: http.MethodGet, RespHTTPCode: http.StatusOK, RespBody: "new"}
+	ms.AddMockups(replaced)
+
+	builder := RequestBuilder{MockServer: ms}
+
+	if resp := builder.Get("http://mytest.com/users"); resp.String() != "new" {
+		t.Fatal("The last mock added should be served", resp.String())
+	}
+
+	if unused := ms.UnusedMocks(); len(unused) != 0 {
+		t.Fatal("Replaced mock should not be unused", len(unused))
+	}
+
+	ms.ResetRequests()
+
+	if len(ms.Requests()) != 0 || len(ms.UnusedMocks()) != 1 {
+		t.Fatal("ResetRequests should forget the requests, not the mocks")
+	}
+
+	builder.Get("http://mytest.com/users")
+	ms.FlushMockups()
+
+	if len(ms.Requests()) != 0 {
+		t.Fatal("FlushMockups should forget the requests")
+	}
+
+	ft.end()
+
+	if len(ft.errors) != 0 {
+		t.Fatal("No mock should be unused", ft.errors)
+	}
+}
+
+func TestMockCassette(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "users.json")
+
+	// Record, from the test server standing in for the upstream
+	recorder := NewMockServer(nil)
+	if err := recorder.UseCassette(&Cassette{Path: path, Mode: CassetteRecord, Upstream: server.URL}); err != nil {
+		t.Fatal("UseCassette failed", err)
+	}
+
+	builder := RequestBuilder{MockServer: recorder, Headers: http.Header{"Authorization": {"Bearer secret"}}}
+
+	resp := builder.Get("http://api.example.com/user")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.String(), "Hernan") {
+		t.Fatal("Recorded request should reach the upstream", resp.StatusCode)
+	}
+
+	if err := recorder.Close(); err != nil {
+		t.Fatal("Close should save the cassette", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil || strings.Contains(string(b), "secret") || !strings.Contains(string(b), Redacted) {
+		t.Fatal("Cassette should be saved with secrets redacted", err)
+	}
+
+	// Replay, without the upstream
+	player := NewMockServer(t)
+	if err := player.UseCassette(&Cassette{Path: path}); err != nil {
+		t.Fatal("UseCassette failed", err)
+	}
+
+	builder = RequestBuilder{MockServer: player, Cache: &ResourceCache{}}
+
+	resp = builder.Get("http://api.example.com/user")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.String(), "Hernan") {
+		t.Fatal("Interaction should be replayed", resp.StatusCode)
+	}
+
+	if resp := builder.Get("http://api.example.com/user/1"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Unrecorded request should not be found when replaying", resp.StatusCode)
+	}
+
+	// Replay or record, adding the new interaction
+	cassette := &Cassette{Path: path, Mode: CassetteReplayOrRecord, Upstream: server.URL}
+
+	ms := NewMockServer(nil)
+	if err := ms.UseCassette(cassette); err != nil {
+		t.Fatal("UseCassette failed", err)
+	}
+
+	builder = RequestBuilder{MockServer: ms, Cache: &ResourceCache{}}
+
+	if resp := builder.Get("http://api.example.com/user/1"); resp.StatusCode != http.StatusOK {
+		t.Fatal("New request should be recorded", resp.StatusCode)
+	}
+
+	if resp := builder.Get("http://api.example.com/user/1"); resp.StatusCode != http.StatusOK {
+		t.Fatal("New interaction should be replayed", resp.StatusCode)
+	}
+
+	ms.Close()
+
+	if len(cassette.Interactions()) != 2 {
+		t.Fatal("Cassette should have both interactions", len(cassette.Interactions()))
+	}
+
+	if err := NewMockServer(t).UseCassette(&Cassette{Path: filepath.Join(t.TempDir(), "none.json")}); err == nil {
+		t.Fatal("Replaying a missing cassette should fail")
+	}
+
+	// Binary bodies, from a mock standing in for the upstream
+	binary := []byte{0xff, 0x00, 0xfe, 'a'}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(binary)
+	}))
+	defer upstream.Close()
+
+	path = filepath.Join(t.TempDir(), "binary.json")
+
+	recorder = NewMockServer(nil)
+	recorder.UseCassette(&Cassette{Path: path, Mode: CassetteRecord, Upstream: upstream.URL})
+
+	builder = RequestBuilder{MockServer: recorder}
+	builder.Get("http://api.example.com/image")
+	recorder.Close()
+
+	b, err = ioutil.ReadFile(path)
+	if err != nil || !strings.Contains(string(b), `"bodyEncoding": "base64"`) {
+		t.Fatal("Binary body should be saved in base64", err)
+	}
+
+	player = NewMockServer(t)
+	if err := player.UseCassette(&Cassette{Path: path}); err != nil {
+		t.Fatal("UseCassette failed", err)
+	}
+
+	builder = RequestBuilder{MockServer: player}
+
+	if resp := builder.Get("http://api.example.com/image"); !bytes.Equal(resp.Bytes(), binary) {
+		t.Fatal("Binary body should be replayed as it was recorded", resp.Bytes())
+	}
+}
+
+func writeFixture(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal("Writing fixture failed", err)
+	}
+}
+
+func TestMockFixtures(t *testing.T) {
+
+	dir := t.TempDir()
+
+	writeFixture(t, filepath.Join(dir, "users.yaml"), `# Users
+- urlPattern: http://mytest.com/users/{id}
+  status: 200
+  headers:
+    Content-Type: application/json
+  body: {"id": 1, "name": "Hernan"}
+
+- url: http://mytest.com/users
+  method: post
+  reqBody:
+    name: Axel
+  status: 201
+  body: |
+    created
+`)
+
+	writeFixture(t, filepath.Join(dir, "orders.json"), `{
+  "url": "http://mytest.com/orders?page=1",
+  "reqHeaders": {"X-Test": ["fixture"]},
+  "bodyFile": "bodies/orders.json"
+}`)
+
+	if err := os.Mkdir(filepath.Join(dir, "bodies"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFixture(t, filepath.Join(dir, "bodies", "orders.json"), `[{"id": 7}]`)
+
+	ms := NewMockServer(t)
+	if err := ms.AddMockupsFromDir(dir); err != nil {
+		t.Fatal("Loading fixtures failed", err)
+	}
+
+	builder := RequestBuilder{MockServer: ms, Headers: http.Header{"X-Test": {"fixture"}}, Cache: &ResourceCache{}}
+
+	resp := builder.Get("http://mytest.com/users/1")
+	if resp.StatusCode != http.StatusOK || resp.String() != `{"id":1,"name":"Hernan"}` {
+		t.Fatal("Inline JSON body should be served", resp.StatusCode, resp.String())
+	}
+
+	resp = builder.Post("http://mytest.com/users", map[string]string{"name": "Axel"})
+	if resp.StatusCode != http.StatusCreated || resp.String() != "created\n" {
+		t.Fatal("Block body should be served", resp.StatusCode, resp.String())
+	}
+
+	resp = builder.Get("http://mytest.com/orders?page=1")
+	if resp.StatusCode != http.StatusOK || resp.String() != `[{"id": 7}]` || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatal("Body file should be served as JSON", resp.StatusCode, resp.String())
+	}
+}
+
+func TestMockFixtureErrors(t *testing.T) {
+
+	dir := t.TempDir()
+
+	cases := []struct {
+		name    string
+		content string
+		line    int
+	}{
+		{"syntax.json", "[\n  {\"url\": \"http://mytest.com\"},\n  {\"url\" \"x\"}\n]", 3},
+		{"type.json", "{\n  \"url\": \"http://mytest.com\",\n  \"status\": \"ok\"\n}", 3},
+		{"unknown.yaml", "- url: http://mytest.com\n  satus: 200\n", 2},
+		{"nourl.yaml", "- url: http://mytest.com\n- method: GET\n", 2},
+		{"bodyfile.yaml", "url: http://mytest.com\n\nbodyFile: missing.json\n", 3},
+		{"indent.yaml", "url: http://mytest.com\n   status: 200\n", 2},
+		{"regexp.yml", "urlRegexp: \"(\"\n", 1},
+		{"alias.yaml", "- url: http://mytest.com\n  body: *users\n", 2},
+		{"flow.yaml", "url: http://mytest.com\nreqQuery: {page: [1,\n  2]}\n", 2},
+	}
+
+	ms := NewMockServer(t)
+
+	for _, c := range cases {
+
+		path := filepath.Join(dir, c.name)
+		writeFixture(t, path, c.content)
+
+		err := ms.AddMockupsFromFile(path)
+
+		fe, ok := err.(*FixtureError)
+		if !ok || fe.File != path || fe.Line != c.line {
+			t.Fatal("Error should point to the line", c.name, err)
+		}
+	}
+
+	if len(ms.allMocks()) != 0 {
+		t.Fatal("Failed files should add no mocks")
+	}
+}
+
+func TestMockFixtureWatch(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "mocks.yaml")
+	writeFixture(t, path, "url: http://mytest.com/watch\nbody: one\n")
+
+	ms := NewMockServer(t)
+
+	errs := make(chan error, 10)
+	stop, err := ms.WatchMockups(path, 10*time.Millisecond, func(err error) { errs <- err })
+	if err != nil {
+		t.Fatal("Watching failed", err)
+	}
+	defer stop()
+
+	builder := RequestBuilder{MockServer: ms}
+
+	if resp := builder.Get("http://mytest.com/watch"); resp.String() != "one" {
+		t.Fatal("Fixture should be loaded", resp.String())
+	}
+
+	// A broken fixture keeps the mocks loaded before
+	writeFixture(t, path, "url: http://mytest.com/watch\nbody: [\n")
+
+	select {
+	case <-errs:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Reload error should be reported")
+	}
+
+	if resp := builder.Get("http://mytest.com/watch"); resp.String() != "one" {
+		t.Fatal("Previous mocks should be kept", resp.String())
+	}
+
+	writeFixture(t, path, "url: http://mytest.com/watch\nbody: two, and longer\n")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for builder.Get("http://mytest.com/watch").String() != "two, and longer" {
+		if time.Now().After(deadline) {
+			t.Fatal("Fixture should be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(ms.allMocks()) != 1 {
+		t.Fatal("Reloaded mocks should replace the old ones", len(ms.allMocks()))
+	}
+}
+
+func TestParseYAMLNode(t *testing.T) {
+
+	node, err := parseYAMLNode([]byte(`---
+name: 'it''s'   # comment
+quoted: "a\tb"
+count: 3
+ratio: 0.5
+on: true
+none: ~
+list:
+- a
+- "b"
+flow: ["x", 1]
+nested:
+  - key: v
+    deep:
+      k: folded
+  -
+    other: 1
+literal: |-
+  line one
+    indented
+folded: >
+  one
+  two
+
+  three
+`))
+	if err != nil {
+		t.Fatal("Parse failed", err)
+	}
+
+	b, _ := json.Marshal(node.plain())
+
+	expected := `{"count":3,"flow":["x",1],"folded":"one two\nthree\n","list":["a","b"],"literal":"line one\n  indented",` +
+		`"name":"it's","nested":[{"deep":{"k":"folded"},"key":"v"},{"other":1}],"none":null,"on":true,"quoted":"a\tb","ratio":0.5}`
+
+	if string(b) != expected {
+		t.Fatal("Unexpected value", string(b))
+	}
+
+	if line := node.lineOf("nested.1.other"); line != 17 {
+		t.Fatal("Unexpected line", line)
+	}
+}
+
+func TestParseYAMLFlow(t *testing.T) {
+
+	node, err := parseYAMLNode([]byte(`- url: http://mytest.com/users
+  reqHeaders: {X-Test: [fixture], 'X-Other': "a, b"}
+  reqQuery: {page: 1, tags: [x, y]}   # comment
+  body: {"id": 1, "name": "Hernan", "url": http://x.com/1}
+  headers: {}
+- # TODO more mocks
+`))
+	if err != nil {
+		t.Fatal("Parse failed", err)
+	}
+
+	b, _ := json.Marshal(node.plain())
+
+	expected := `[{"body":{"id":1,"name":"Hernan","url":"http://x.com/1"},"headers":{},` +
+		`"reqHeaders":{"X-Other":"a, b","X-Test":["fixture"]},"reqQuery":{"page":1,"tags":["x","y"]},"url":"http://mytest.com/users"},null]`
+
+	if string(b) != expected {
+		t.Fatal("Unexpected value", string(b))
+	}
+
+	path := filepath.Join(t.TempDir(), "todo.yaml")
+	writeFixture(t, path, "- url: http://x.com/u\n- # TODO more mocks\n")
+
+	ms := NewMockServer(t)
+	if err := ms.AddMockupsFromFile(path); err != nil || len(ms.allMocks()) != 1 {
+		t.Fatal("Commented out item should add nothing", err)
+	}
+
+	for _, doc := range []string{"a: [x,\n  y]\n", "a: &anchor x\n", "a: x\n---\nb: y\n"} {
+		if _, err := parseYAMLNode([]byte(doc)); err == nil || !strings.Contains(err.Error(), "unsupported YAML") {
+			t.Fatal("Should fail as unsupported YAML", doc, err)
+		}
+	}
+}
+
+func TestMockDynamic(t *testing.T) {
+
+	ms := NewMockServer(t)
+
+	echo := &Mock{
+		URLPattern: "http://mytest.com/echo/{id}",
+		HTTPMethod: http.MethodPost,
+		Handler: func(w http.ResponseWriter, req *http.Request) {
+			b, _ := ioutil.ReadAll(req.Body)
+			w.Header().Set("X-Id", MockVars(req)["id"])
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "%s %s %s", req.URL.Query().Get("q"), req.Header.Get("X-Test"), b)
+		},
+	}
+
+	tmpl := &Mock{
+		URLPattern:   "http://mytest.com/users/{id}",
+		HTTPMethod:   http.MethodPut,
+		RespHTTPCode: http.StatusOK,
+		RespTemplate: true,
+		RespBody:     `{{.Vars.id}} {{.Query.Get "page"}} {{.Headers.Get "X-Test"}} {{.JSON.name}} {{json .JSON.id}} {{if gt now.Year 2000}}now{{end}}`,
+	}
+
+	ms.AddMockups(echo, tmpl)
+
+	builder := RequestBuilder{MockServer: ms, Headers: http.Header{"X-Test": {"dynamic"}}}
+
+	resp := builder.Post("http://mytest.com/echo/42?q=hi", "body")
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("X-Id") != "42" || resp.String() != `hi dynamic "body"` {
+		t.Fatal("Handler should compute the response", resp.StatusCode, resp.String())
+	}
+
+	resp = builder.Put("http://mytest.com/users/7?page=2", &User{Id: 7, Name: "Matilda"})
+	if resp.StatusCode != http.StatusOK || resp.String() != "7 2 dynamic Matilda 7 now" {
+		t.Fatal("Template should be rendered with the request data", resp.String())
+	}
+}
+
+// Unmatched requests are reported after the first line
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+func TestMockMissReport(t *testing.T) {
+
+	ft := new(fakeT)
+	ms := NewMockServer(ft)
+	ms.Strict = true
+
+	ms.AddMockups(
+		&Mock{
+			URL:          "http://mytest.com/users?page=1&size=10",
+			HTTPMethod:   http.MethodGet,
+			ReqHeaders:   http.Header{"X-Tenant": {"acme"}},
+			RespHTTPCode: http.StatusOK,
+		},
+		&Mock{
+			URLPattern:   "http://mytest.com/users/{id}",
+			HTTPMethod:   http.MethodPost,
+			ReqBody:      `{"name":"Axel"}`,
+			ReqBodyMatch: BodyJSON,
+			RespHTTPCode: http.StatusOK,
+		},
+		&Mock{
+			URL:          "http://other.com/items",
+			HTTPMethod:   http.MethodDelete,
+			RespHTTPCode: http.StatusOK,
+		},
+	)
+
+	builder := RequestBuilder{MockServer: ms, Headers: http.Header{"X-Tenant": {"acme"}}, DisableCache: true}
+
+	resp := builder.Get("http://mytest.com/users?size=10&pgae=1")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Unmatched request should be a bad request", resp.StatusCode)
+	}
+
+	report := resp.String()
+
+	for _, s := range []string{
+		MOCK_NOT_FOUND_ERROR + "\n",
+		"Looked up key: GET http://mytest.com/users?pgae=1&size=10",
+		"1. GET http://mytest.com/users?page=1&size=10\n   - query param page: want \"1\", missing\n   - query param pgae: unexpected \"1\"\n2.",
+	} {
+		if !strings.Contains(report, s) {
+			t.Fatal("Report should contain", s, "got", report)
+		}
+	}
+
+	report = builder.Post("http://mytest.com/users/7", map[string]string{"name": "Mateo"}).String()
+
+	if !strings.Contains(report, "1. POST http://mytest.com/users/{id}\n   - body: want \"{\\\"name\\\":\\\"Axel\\\"}\", got") {
+		t.Fatal("Report should show the body difference", report)
+	}
+
+	requests := ms.Requests()
+	if requests[0].Miss == "" || requests[0].Mock != nil {
+		t.Fatal("Requests should keep the report")
+	}
+
+	if len(ft.errors) != 0 {
+		t.Fatal("Unmatched requests should be reported when the test ends", ft.errors)
+	}
+
+	ft.end()
+	if len(ft.errors) != 2 || !strings.Contains(ft.errors[0], "No mock matches GET") {
+		t.Fatal("Strict mode should fail the test on every unmatched request", ft.errors)
+	}
+}
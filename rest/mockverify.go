@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+)
+
+// MockRequest is a request received by a MockServer
+type MockRequest struct {
+	Method string
+
+	// Original URL of the request, not the one of the MockServer
+	URL string
+
+	Header http.Header
+	Body   []byte
+	Time   time.Time
+
+	// Mock that served the request. Nil if none matched
+	Mock *Mock
+
+	// Why no mock matched: the closest ones, and how they differ.
+	// Empty if one did
+	Miss string
+}
+
+// Lock must be held
+func (ms *MockServer) record(req *http.Request, body []byte, m *Mock, miss string) {
+
+	header := req.Header.Clone()
+	header.Del("X-Original-URL")
+
+	ms.requests = append(ms.requests, MockRequest{
+		Method: req.Method,
+		URL:    req.Header.Get("X-Original-URL"),
+		Header: header,
+		Body:   body,
+		Time:   time.Now(),
+		Mock:   m,
+		Miss:   miss,
+	})
+}
+
+// Requests returns every request received, in order.
+func (ms *MockServer) Requests() []MockRequest {
+
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	return append([]MockRequest(nil), ms.requests...)
+}
+
+// ResetRequests forgets the requests received, keeping the mocks.
+func (ms *MockServer) ResetRequests() {
+	ms.mtx.Lock()
+	ms.requests = nil
+	ms.mtx.Unlock()
+}
+
+// RequestsOf returns the requests served by a mock, in order.
+func (ms *MockServer) RequestsOf(m *Mock) []MockRequest {
+
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	var requests []MockRequest
+	for _, r := range ms.requests {
+		if r.Mock == m {
+			requests = append(requests, r)
+		}
+	}
+
+	return requests
+}
+
+// Calls returns the number of requests served by a mock.
+func (ms *MockServer) Calls(m *Mock) int {
+	return len(ms.RequestsOf(m))
+}
+
+// UnusedMocks returns the mocks that never served a request.
+func (ms *MockServer) UnusedMocks() []*Mock {
+
+	ms.mtx.RLock()
+	defer ms.mtx.RUnlock()
+
+	used := make(map[*Mock]bool)
+	for _, r := range ms.requests {
+		used[r.Mock] = true
+	}
+
+	var unused []*Mock
+	for _, e := range ms.allMocks() {
+		if !used[e.Mock] {
+			unused = append(unused, e.Mock)
+		}
+	}
+
+	return unused
+}
+
+// AssertCalled checks that a mock served exactly times requests.
+func (ms *MockServer) AssertCalled(t MockT, m *Mock, times int) bool {
+
+	t.Helper()
+
+	if calls := ms.Calls(m); calls != times {
+		t.Errorf("Mock %s %s called %d times, expected %d", m.HTTPMethod, m.mockURL(), calls, times)
+		return false
+	}
+
+	return true
+}
+
+// AssertNotCalled checks that a mock never served a request.
+func (ms *MockServer) AssertNotCalled(t MockT, m *Mock) bool {
+	t.Helper()
+	return ms.AssertCalled(t, m, 0)
+}
+
+// AssertCalledWithBody checks that a mock served a request with this body.
+// JSON bodies are compared as JSON values.
+func (ms *MockServer) AssertCalledWithBody(t MockT, m *Mock, body string) bool {
+
+	t.Helper()
+
+	requests := ms.RequestsOf(m)
+
+	for _, r := range requests {
+		if string(r.Body) == body || jsonEqual(r.Body, []byte(body)) {
+			return true
+		}
+	}
+
+	t.Errorf("Mock %s %s not called with body %s, in %d calls", m.HTTPMethod, m.mockURL(), body, len(requests))
+	return false
+}
+
+// AssertAllUsed checks that every mock served at least a request.
+func (ms *MockServer) AssertAllUsed(t MockT) bool {
+
+	t.Helper()
+
+	unused := ms.UnusedMocks()
+
+	for _, m := range unused {
+		t.Errorf("Mock %s %s was never called", m.HTTPMethod, m.mockURL())
+	}
+
+	return len(unused) == 0
+}
+
+// Every mock, in the order they were added. Lock must be held
+func (ms *MockServer) allMocks() []*mockEntry {
+
+	var mocks []*mockEntry
+
+	for _, byURL := range ms.mocks {
+		mocks = append(mocks, byURL...)
+	}
+
+	mocks = append(mocks, ms.patterns...)
+
+	sortMocks(mocks)
+
+	return mocks
+}
@@ -0,0 +1,819 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fixtureNode is a value of a fixture file, with the line it starts at, so
+// errors can point to it. Its value is a map[string]*fixtureNode, a
+// []*fixtureNode, or a scalar: string, json.Number, bool or nil.
+type fixtureNode struct {
+	line  int
+	value interface{}
+}
+
+// The value, without lines, as encoding/json would decode it
+func (n *fixtureNode) plain() interface{} {
+
+	switch v := n.value.(type) {
+
+	case map[string]*fixtureNode:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[k] = child.plain()
+		}
+		return m
+
+	case []*fixtureNode:
+		l := make([]interface{}, len(v))
+		for i, child := range v {
+			l[i] = child.plain()
+		}
+		return l
+	}
+
+	return n.value
+}
+
+// The line of the value at a dotted path of keys and indexes. As deep as the
+// path could be followed.
+func (n *fixtureNode) lineOf(path string) int {
+
+	node := n
+
+	for _, p := range strings.Split(path, ".") {
+
+		switch v := node.value.(type) {
+
+		case map[string]*fixtureNode:
+			child := v[p]
+			if child == nil {
+				return node.line
+			}
+			node = child
+
+		case []*fixtureNode:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(v) {
+				return node.line
+			}
+			node = v[i]
+
+		default:
+			return node.line
+		}
+	}
+
+	return node.line
+}
+
+// The line of a key, anywhere within the node. Zero if not found
+func (n *fixtureNode) lineOfKey(key string) int {
+
+	switch v := n.value.(type) {
+
+	case map[string]*fixtureNode:
+		if child := v[key]; child != nil {
+			return child.line
+		}
+		for _, child := range v {
+			if line := child.lineOfKey(key); line > 0 {
+				return line
+			}
+		}
+
+	case []*fixtureNode:
+		for _, child := range v {
+			if line := child.lineOfKey(key); line > 0 {
+				return line
+			}
+		}
+	}
+
+	return 0
+}
+
+// parseJSONNode parses a JSON document, keeping the line of every value
+func parseJSONNode(data []byte) (*fixtureNode, error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	node, err := decodeJSONNode(decoder, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := decoder.Token(); err == nil {
+		return nil, &FixtureError{Line: lineAt(data, decoder.InputOffset()), Err: errors.New("unexpected data after the document")}
+	}
+
+	return node, nil
+}
+
+func decodeJSONNode(decoder *json.Decoder, data []byte) (*fixtureNode, error) {
+
+	line := lineAt(data, decoder.InputOffset())
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, jsonFixtureError(err, data, line)
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return &fixtureNode{line: line, value: token}, nil
+	}
+
+	switch delim {
+
+	case '{':
+		m := make(map[string]*fixtureNode)
+		for decoder.More() {
+
+			key, err := decoder.Token()
+			if err != nil {
+				return nil, jsonFixtureError(err, data, line)
+			}
+
+			value, err := decodeJSONNode(decoder, data)
+			if err != nil {
+				return nil, err
+			}
+
+			m[key.(string)] = value
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, jsonFixtureError(err, data, line)
+		}
+		return &fixtureNode{line: line, value: m}, nil
+
+	case '[':
+		l := []*fixtureNode{}
+		for decoder.More() {
+			value, err := decodeJSONNode(decoder, data)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, value)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, jsonFixtureError(err, data, line)
+		}
+		return &fixtureNode{line: line, value: l}, nil
+	}
+
+	return nil, &FixtureError{Line: line, Err: fmt.Errorf("unexpected %v", delim)}
+}
+
+// Syntax errors carry their offset, others get the line of the value
+func jsonFixtureError(err error, data []byte, line int) error {
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line = lineAt(data, syntaxErr.Offset)
+	}
+
+	return &FixtureError{Line: line, Err: err}
+}
+
+// The line of the next token after offset, counting from 1
+func lineAt(data []byte, offset int64) int {
+
+	i := int(offset)
+	if i > len(data) {
+		i = len(data)
+	}
+
+	for i < len(data) && strings.IndexByte(" \t\r\n,:", data[i]) >= 0 {
+		i++
+	}
+
+	return bytes.Count(data[:i], []byte("\n")) + 1
+}
+
+// A YAML line, without its indentation
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+	raw    string
+}
+
+func (l *yamlLine) blank() bool {
+	return l.text == "" || strings.HasPrefix(l.text, "#")
+}
+
+// yamlParser parses the subset of YAML used by fixtures: block mappings and
+// sequences, plain and quoted scalars, literal (|) and folded (>) block
+// scalars, and flow collections, as in [a, b] or {k: v}, on a single line.
+// Anchors, aliases, tags and multiple documents are unsupported YAML, and
+// fail as such.
+type yamlParser struct {
+	lines []*yamlLine
+	pos   int
+}
+
+var yamlInt = regexp.MustCompile(`^[-+]?[0-9]+$`)
+var yamlFloat = regexp.MustCompile(`^[-+]?([0-9]+\.[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// parseYAMLNode parses a YAML document, keeping the line of every value
+func parseYAMLNode(data []byte) (*fixtureNode, error) {
+
+	p := &yamlParser{}
+
+	for i, raw := range strings.Split(string(data), "\n") {
+
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+
+		if strings.HasPrefix(text, "\t") {
+			return nil, &FixtureError{Line: i + 1, Err: errors.New("tabs are not allowed for indentation")}
+		}
+
+		if i == 0 && strings.TrimSpace(text) == "---" {
+			text = ""
+		}
+
+		if i > 0 && (raw == "---" || raw == "...") {
+			return nil, &FixtureError{Line: i + 1, Err: errors.New("unsupported YAML: multiple documents")}
+		}
+
+		p.lines = append(p.lines, &yamlLine{
+			num:    i + 1,
+			indent: len(raw) - len(text),
+			text:   strings.TrimRight(text, " \t"),
+			raw:    raw,
+		})
+	}
+
+	line := p.next()
+	if line == nil {
+		return &fixtureNode{line: 1}, nil
+	}
+
+	node, err := p.parseNode(line.indent)
+	if err != nil {
+		return nil, err
+	}
+
+	if line := p.next(); line != nil {
+		return nil, &FixtureError{Line: line.num, Err: errors.New("bad indentation")}
+	}
+
+	return node, nil
+}
+
+// The next line with content, skipping blank lines and comments
+func (p *yamlParser) next() *yamlLine {
+
+	for p.pos < len(p.lines) {
+		if l := p.lines[p.pos]; !l.blank() {
+			return l
+		}
+		p.pos++
+	}
+
+	return nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// Parses the node starting at the current line, indented by indent
+func (p *yamlParser) parseNode(indent int) (*fixtureNode, error) {
+
+	// Only comments left
+	line := p.next()
+	if line == nil {
+		return &fixtureNode{line: len(p.lines)}, nil
+	}
+
+	if isSequenceItem(line.text) {
+		return p.parseSequence(indent)
+	}
+
+	_, _, ok, err := splitYAMLKey(line)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		return p.parseMapping(indent)
+	}
+
+	p.pos++
+
+	return parseYAMLScalar(line.text, line.num)
+}
+
+func (p *yamlParser) parseSequence(indent int) (*fixtureNode, error) {
+
+	node := &fixtureNode{line: p.next().num}
+	items := []*fixtureNode{}
+
+	for {
+
+		line := p.next()
+		if line == nil || line.indent < indent {
+			break
+		}
+
+		if line.indent > indent {
+			return nil, &FixtureError{Line: line.num, Err: errors.New("bad indentation of a sequence item")}
+		}
+
+		// A sequence at the same indentation as its key ends with the next key
+		if !isSequenceItem(line.text) {
+			break
+		}
+
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+
+		var item *fixtureNode
+		var err error
+
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			p.pos++
+			item, err = p.parseChild(indent, line.num)
+		} else {
+			// The item content is parsed as if it were on a line of its own,
+			// so mapping keys following it line up with it
+			line.indent += len(line.text) - len(rest)
+			line.text = rest
+			item, err = p.parseNode(line.indent)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	node.value = items
+
+	return node, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (*fixtureNode, error) {
+
+	node := &fixtureNode{line: p.next().num}
+	m := make(map[string]*fixtureNode)
+
+	for {
+
+		line := p.next()
+		if line == nil || line.indent < indent {
+			break
+		}
+
+		if line.indent > indent {
+			return nil, &FixtureError{Line: line.num, Err: errors.New("bad indentation of a mapping entry")}
+		}
+
+		key, rest, ok, err := splitYAMLKey(line)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &FixtureError{Line: line.num, Err: errors.New("expected a key: value entry")}
+		}
+
+		if _, dup := m[key]; dup {
+			return nil, &FixtureError{Line: line.num, Err: fmt.Errorf("duplicated key %q", key)}
+		}
+
+		p.pos++
+
+		var value *fixtureNode
+
+		switch {
+		case rest == "" || strings.HasPrefix(rest, "#"):
+			// A sequence may be at the same indentation as its key
+			if next := p.next(); next != nil && next.indent == indent && isSequenceItem(next.text) {
+				value, err = p.parseSequence(indent)
+			} else {
+				value, err = p.parseChild(indent, line.num)
+			}
+
+		case strings.HasPrefix(rest, "|") || strings.HasPrefix(rest, ">"):
+			value, err = p.parseBlockScalar(indent, rest, line.num)
+
+		default:
+			value, err = parseYAMLScalar(rest, line.num)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		m[key] = value
+	}
+
+	node.value = m
+
+	return node, nil
+}
+
+// The node indented under a key or a sequence dash, null if there's none
+func (p *yamlParser) parseChild(indent int, num int) (*fixtureNode, error) {
+
+	next := p.next()
+	if next == nil || next.indent <= indent {
+		return &fixtureNode{line: num}, nil
+	}
+
+	return p.parseNode(next.indent)
+}
+
+// Literal (|) and folded (>) block scalars, with their chomping indicator
+func (p *yamlParser) parseBlockScalar(indent int, header string, num int) (*fixtureNode, error) {
+
+	if i := strings.Index(header, " #"); i >= 0 {
+		header = strings.TrimSpace(header[:i])
+	}
+
+	folded := header[0] == '>'
+	chomp := header[1:]
+
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, &FixtureError{Line: num, Err: fmt.Errorf("unsupported block scalar header %q", header)}
+	}
+
+	var lines []string
+	contentIndent := -1
+
+	for ; p.pos < len(p.lines); p.pos++ {
+
+		line := p.lines[p.pos]
+
+		if line.text == "" {
+			lines = append(lines, "")
+			continue
+		}
+
+		if line.indent <= indent {
+			break
+		}
+
+		if contentIndent < 0 {
+			contentIndent = line.indent
+		}
+
+		if line.indent < contentIndent {
+			return nil, &FixtureError{Line: line.num, Err: errors.New("bad indentation of a block scalar")}
+		}
+
+		lines = append(lines, line.raw[contentIndent:])
+	}
+
+	// Trailing blank lines belong to the chomping, not to the content
+	content := lines
+	for len(content) > 0 && content[len(content)-1] == "" {
+		content = content[:len(content)-1]
+	}
+
+	var s string
+	if folded {
+		s = foldYAMLLines(content)
+	} else {
+		s = strings.Join(content, "\n")
+	}
+
+	switch {
+	case len(content) == 0:
+	case chomp == "-":
+	case chomp == "+":
+		s += strings.Repeat("\n", len(lines)-len(content)+1)
+	default:
+		s += "\n"
+	}
+
+	return &fixtureNode{line: num, value: s}, nil
+}
+
+// Lines are joined by a space, blank lines are new lines
+func foldYAMLLines(lines []string) string {
+
+	var b strings.Builder
+
+	for i, l := range lines {
+		switch {
+		case i == 0:
+		case l == "" || lines[i-1] == "":
+			if l == "" {
+				b.WriteString("\n")
+			}
+		default:
+			b.WriteString(" ")
+		}
+		b.WriteString(l)
+	}
+
+	return b.String()
+}
+
+// Splits a mapping entry in key and value. Not ok if the line is not one
+func splitYAMLKey(line *yamlLine) (string, string, bool, error) {
+
+	text := line.text
+
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, `'`) {
+
+		end := quotedEnd(text)
+		if end < 0 {
+			return "", "", false, &FixtureError{Line: line.num, Err: errors.New("unclosed quoted string")}
+		}
+
+		rest := strings.TrimLeft(text[end:], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false, nil
+		}
+
+		key, err := parseYAMLScalar(text[:end], line.num)
+		if err != nil {
+			return "", "", false, err
+		}
+
+		return fmt.Sprint(key.value), strings.TrimSpace(rest[1:]), true, nil
+	}
+
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", "", false, nil
+	}
+
+	if strings.HasSuffix(text, ":") && !strings.Contains(text, ": ") {
+		return strings.TrimSpace(text[:len(text)-1]), "", true, nil
+	}
+
+	i := strings.Index(text, ": ")
+	if i < 0 || strings.Contains(text[:i], " #") {
+		return "", "", false, nil
+	}
+
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:]), true, nil
+}
+
+// The end of the quoted string at the start of s, after the closing quote.
+// -1 if it is not closed
+func quotedEnd(s string) int {
+
+	quote := s[0]
+
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case s[i] == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+func parseYAMLScalar(text string, num int) (*fixtureNode, error) {
+
+	node := &fixtureNode{line: num}
+
+	if text == "" {
+		return node, nil
+	}
+
+	if text[0] == '[' || text[0] == '{' {
+		return parseYAMLFlow(text, num)
+	}
+
+	if strings.IndexByte("&*!", text[0]) >= 0 {
+		return nil, &FixtureError{Line: num, Err: errors.New("unsupported YAML: anchors, aliases and tags")}
+	}
+
+	if text[0] == '"' || text[0] == '\'' {
+
+		end := quotedEnd(text)
+		if end < 0 {
+			return nil, &FixtureError{Line: num, Err: errors.New("unclosed quoted string")}
+		}
+
+		if rest := strings.TrimSpace(text[end:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, &FixtureError{Line: num, Err: errors.New("unexpected text after quoted string")}
+		}
+
+		if text[0] == '\'' {
+			node.value = strings.Replace(text[1:end-1], "''", "'", -1)
+			return node, nil
+		}
+
+		s, err := strconv.Unquote(text[:end])
+		if err != nil {
+			return nil, &FixtureError{Line: num, Err: errors.New("invalid double quoted string")}
+		}
+
+		node.value = s
+		return node, nil
+	}
+
+	if i := strings.Index(text, " #"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+
+	switch text {
+	case "null", "Null", "NULL", "~":
+	case "true", "True", "TRUE":
+		node.value = true
+	case "false", "False", "FALSE":
+		node.value = false
+	default:
+		if yamlInt.MatchString(text) || yamlFloat.MatchString(text) {
+			node.value = json.Number(strings.TrimPrefix(text, "+"))
+		} else {
+			node.value = text
+		}
+	}
+
+	return node, nil
+}
+
+// yamlFlow parses a flow collection, as in [a, "b"] or {k: [v]}. JSON is
+// one too. It must end on the line it starts
+type yamlFlow struct {
+	text string
+	pos  int
+	num  int
+}
+
+func parseYAMLFlow(text string, num int) (*fixtureNode, error) {
+
+	f := &yamlFlow{text: text, num: num}
+
+	node, err := f.parseValue(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if rest := strings.TrimSpace(text[f.pos:]); rest != "" && !strings.HasPrefix(rest, "#") {
+		return nil, f.errorf("unexpected %q after flow collection", rest)
+	}
+
+	return node, nil
+}
+
+func (f *yamlFlow) errorf(format string, args ...interface{}) error {
+	return &FixtureError{Line: f.num, Err: fmt.Errorf(format, args...)}
+}
+
+func (f *yamlFlow) skipSpaces() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+// The next character, after spaces. Zero at the end of the line
+func (f *yamlFlow) peek() byte {
+
+	f.skipSpaces()
+
+	if f.pos == len(f.text) {
+		return 0
+	}
+
+	return f.text[f.pos]
+}
+
+// A value inside the collection. Plain keys end at a colon
+func (f *yamlFlow) parseValue(key bool) (*fixtureNode, error) {
+
+	switch c := f.peek(); c {
+
+	case 0:
+		return nil, f.errorf("unsupported YAML: flow collection not closed on its line")
+
+	case '[':
+		return f.parseSequence()
+
+	case '{':
+		return f.parseMapping()
+
+	case '"', '\'':
+		end := quotedEnd(f.text[f.pos:])
+		if end < 0 {
+			return nil, f.errorf("unclosed quoted string")
+		}
+		quoted := f.text[f.pos : f.pos+end]
+		f.pos += end
+		return parseYAMLScalar(quoted, f.num)
+	}
+
+	start := f.pos
+
+	for ; f.pos < len(f.text); f.pos++ {
+
+		c := f.text[f.pos]
+
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+
+		if key && c == ':' && (f.pos+1 == len(f.text) || strings.IndexByte(" ,]}", f.text[f.pos+1]) >= 0) {
+			break
+		}
+	}
+
+	plain := strings.TrimSpace(f.text[start:f.pos])
+
+	if plain != "" && strings.IndexByte("&*!", plain[0]) >= 0 {
+		return nil, f.errorf("unsupported YAML: %q in flow collection", plain)
+	}
+
+	return parseYAMLScalar(plain, f.num)
+}
+
+func (f *yamlFlow) parseSequence() (*fixtureNode, error) {
+
+	f.pos++
+	items := []*fixtureNode{}
+
+	for f.peek() != ']' {
+
+		item, err := f.parseValue(false)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+
+		if err := f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+
+	f.pos++
+
+	return &fixtureNode{line: f.num, value: items}, nil
+}
+
+func (f *yamlFlow) parseMapping() (*fixtureNode, error) {
+
+	f.pos++
+	m := make(map[string]*fixtureNode)
+
+	for f.peek() != '}' {
+
+		key, err := f.parseValue(true)
+		if err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprint(key.value)
+		if _, dup := m[name]; dup {
+			return nil, f.errorf("duplicated key %q", name)
+		}
+
+		// A key without value is null
+		value := &fixtureNode{line: f.num}
+
+		if f.peek() == ':' {
+			f.pos++
+			if c := f.peek(); c != ',' && c != '}' {
+				if value, err = f.parseValue(false); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		m[name] = value
+
+		if err := f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+
+	f.pos++
+
+	return &fixtureNode{line: f.num, value: m}, nil
+}
+
+// Skips the comma after an entry, if it is not the last one
+func (f *yamlFlow) separator(end byte) error {
+
+	switch f.peek() {
+	case 0:
+		return f.errorf("unsupported YAML: flow collection not closed on its line")
+	case ',':
+		f.pos++
+		return nil
+	case end:
+		return nil
+	}
+
+	return f.errorf("expected , or %c in flow collection, at %q", end, f.text[f.pos:])
+}
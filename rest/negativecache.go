@@ -0,0 +1,100 @@
+package rest
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultNegativeTTL is the TTL of negative cached Responses, for NegativeCaches
+// that don't set one
+var DefaultNegativeTTL = 10 * time.Second
+
+// NegativeCache caches error Responses, like 404 (Not Found), for a short
+// TTL. So a missing resource doesn't hit the upstream on every request.
+//
+// Negative Responses are kept in their own storage, with its own size, so
+// misses never evict the Responses in the RequestBuilder Cache.
+type NegativeCache struct {
+
+	// Status codes to be cached. Empty means 404 (Not Found) and 410 (Gone)
+	StatusCodes []int
+
+	// TTL of the Responses. Zero means DefaultNegativeTTL
+	TTL time.Duration
+
+	// Maximum Byte Size to be hold by the cache. Zero means 10 MegaBytes
+	MaxSize ByteSize
+
+	// Clock used for TTL. Nil means the system clock
+	Clock Clock
+
+	initOnce sync.Once
+	cache    ResourceCache
+}
+
+// This will be executed only once per cache
+func (nc *NegativeCache) init() {
+
+	nc.initOnce.Do(func() {
+
+		nc.cache.MaxSize = nc.MaxSize
+		if nc.cache.MaxSize == 0 {
+			nc.cache.MaxSize = 10 * MB
+		}
+
+		nc.cache.Clock = nc.Clock
+	})
+
+}
+
+// Close closes the negative storage. A closed NegativeCache stores nothing.
+func (nc *NegativeCache) Close() error {
+	nc.init()
+	return nc.cache.Close()
+}
+
+func (nc *NegativeCache) match(statusCode int) bool {
+
+	if len(nc.StatusCodes) == 0 {
+		return statusCode == http.StatusNotFound || statusCode == http.StatusGone
+	}
+
+	for _, code := range nc.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (nc *NegativeCache) get(key string) *Response {
+	nc.init()
+	return nc.cache.get(key)
+}
+
+// Stores the Response if its status code is one to be cached.
+// Returns true if it's a negative Response, stored or not.
+func (nc *NegativeCache) setNX(key string, resp *Response) bool {
+
+	if !nc.match(resp.StatusCode) {
+		return false
+	}
+
+	nc.init()
+
+	ttl := nc.TTL
+	if ttl <= 0 {
+		ttl = DefaultNegativeTTL
+	}
+
+	t := nc.cache.now().Add(ttl)
+
+	resp.ttl = &t
+	resp.revalidate = false
+
+	nc.cache.setNX(key, resp)
+
+	return true
+}
@@ -0,0 +1,110 @@
+package rest
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	negative := &NegativeCache{TTL: time.Second, Clock: clock}
+	defer negative.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache, NegativeCache: negative}
+
+	hits := atomic.LoadInt64(&missingHits)
+
+	if r := builder.Get("/missing/1"); r.StatusCode != http.StatusNotFound {
+		t.Fatal("Status != Not Found (404)")
+	}
+
+	r := builder.Get("/missing/1")
+	if !r.CacheHit() || r.StatusCode != http.StatusNotFound {
+		t.Fatal("404 should be cached")
+	}
+
+	if atomic.LoadInt64(&missingHits)-hits != 1 {
+		t.Fatal("Upstream should be hit once")
+	}
+
+	if atomic.LoadInt64(&cache.size) != 0 {
+		t.Fatal("404 should not be in the positive cache")
+	}
+
+	clock.Advance(2 * time.Second)
+
+	if builder.Get("/missing/1").CacheHit() {
+		t.Fatal("404 should have expired")
+	}
+
+}
+
+func TestNegativeCacheStatusCodes(t *testing.T) {
+
+	negative := &NegativeCache{StatusCodes: []int{http.StatusGone}}
+	defer negative.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, NegativeCache: negative}
+
+	builder.Get("/missing/2")
+
+	if builder.Get("/missing/2").CacheHit() {
+		t.Fatal("404 is not in StatusCodes, should not be cached")
+	}
+
+}
+
+func TestNegativeCacheRevalidated(t *testing.T) {
+
+	negative := &NegativeCache{}
+	defer negative.Close()
+
+	deleted := &Mock{
+		URL:        "http://mytest.com/users/1",
+		HTTPMethod: http.MethodGet,
+		Responses: []MockResponse{
+			{HTTPCode: http.StatusOK, Headers: http.Header{"ETag": {`"v1"`}}, Body: "user"},
+			{HTTPCode: http.StatusNotFound},
+		},
+	}
+
+	private := &Mock{
+		URL:          "http://mytest.com/users/2",
+		HTTPMethod:   http.MethodGet,
+		RespHTTPCode: http.StatusNotFound,
+		RespHeaders:  http.Header{"Cache-Control": {"no-store"}},
+	}
+
+	ms := NewMockServer(t)
+	ms.AddMockups(deleted, private)
+
+	builder := RequestBuilder{MockServer: ms, NegativeCache: negative}
+
+	builder.Get("http://mytest.com/users/1")
+
+	if r := builder.Get("http://mytest.com/users/1"); r.StatusCode != http.StatusNotFound {
+		t.Fatal("Revalidation should find the resource deleted", r.StatusCode)
+	}
+
+	if r := builder.Get("http://mytest.com/users/1"); !r.CacheHit() || r.StatusCode != http.StatusNotFound {
+		t.Fatal("404 should be served from the NegativeCache, over the cached Response to revalidate")
+	}
+
+	if calls := ms.Calls(deleted); calls != 2 {
+		t.Fatal("Upstream should be hit twice", calls)
+	}
+
+	builder.Get("http://mytest.com/users/2")
+
+	if builder.Get("http://mytest.com/users/2").CacheHit() {
+		t.Fatal("no-store 404 should not be cached")
+	}
+
+}
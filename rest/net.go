@@ -2,6 +2,8 @@ package rest
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -15,42 +17,100 @@ import (
 	"time"
 )
 
-var readVerbs = [3]string{http.MethodGet, http.MethodHead, http.MethodOptions}
-var contentVerbs = [3]string{http.MethodPost, http.MethodPut, http.MethodPatch}
-var defaultCheckRedirectFunc func(req *http.Request, via []*http.Request) error
+var readVerbs = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+var contentVerbs = []string{http.MethodPost, http.MethodPut, http.MethodPatch, MethodQuery}
+
+// Verbs that may be cached, keyed by their body, with CachePostQueries
+var queryVerbs = []string{http.MethodPost, MethodQuery}
 
 var maxAge = regexp.MustCompile(`(?:max-age|s-maxage)=(\d+)`)
 
-const httpDateFormat string = "Mon, 01 Jan 2006 15:04:05 GMT"
+const httpDateFormat string = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+func (rb *RequestBuilder) doRequest(verb string, reqURL string, reqBody interface{}) *Response {
+
+	if !rb.acquire() {
+		return &Response{Err: ErrBuilderClosed}
+	}
+
+	defer rb.inFlight.Done()
+
+	return rb.sendRequest(verb, reqURL, reqBody)
+}
 
-func (rb *RequestBuilder) doRequest(verb string, reqURL string, reqBody interface{}) (result *Response) {
+func (rb *RequestBuilder) sendRequest(verb string, reqURL string, reqBody interface{}) *Response {
+	return rb.send(verb, rb.BaseURL+reqURL, reqBody, nil, false)
+}
+
+// A refresh skips the cache lookup, and replaces the cached Response
+func (rb *RequestBuilder) send(verb string, reqURL string, reqBody interface{}, cc *CacheControl, refresh bool) (result *Response) {
 	var cacheURL string
 	var cacheResp *Response
 
 	result = new(Response)
-	reqURL = rb.BaseURL + reqURL
+	cache := rb.getCache()
+
+	// Whatever is cached may be needed once offline
+	if rb.Offline || rb.StaleIfOffline {
+		cache.keepExpired()
+	}
+
+	//Marshal request to JSON or XML
+	body, err := rb.marshalReqBody(reqBody)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	// Queries are keyed by their body too
+	query := rb.CachePostQueries && matchVerbs(verb, queryVerbs)
+	cacheKey := reqURL
+	if query {
+		cacheKey = bodyCacheKey(reqURL, verb, body)
+	}
 
 	//If Cache enable && operation is read: Cache GET
-	if !rb.DisableCache && matchVerbs(verb, readVerbs) {
-		if cacheResp = resourceCache.get(reqURL); cacheResp != nil {
+	if !refresh && !rb.DisableCache && (query || matchVerbs(verb, readVerbs)) {
+		if cacheResp = cache.get(cacheKey); cacheResp != nil {
 			cacheResp.cacheHit.Store(true)
-			if !cacheResp.revalidate {
+			if now := cache.now(); cc.usable(cacheResp, now) {
+				if cacheResp.expired(now) {
+					return cacheResp.staleCopy()
+				}
+
+				rb.refreshAhead(verb, reqURL, reqBody, cacheKey, cacheResp)
 				return cacheResp
 			}
 		}
+
+		// Also when the cached Response is not usable, as the resource may be
+		// gone since it was cached
+		if nc := rb.NegativeCache; nc != nil && !cc.noCache() {
+			if negResp := nc.get(cacheKey); negResp != nil {
+				negResp.cacheHit.Store(true)
+				return negResp
+			}
+		}
 	}
 
-	func(verb string, reqURL string, reqBody interface{}) {
+	// Nothing usable in cache, and the network must not be used
+	if cc.onlyIfCached() {
+		return gatewayTimeout(verb, reqURL)
+	}
 
-		//Marshal request to JSON or XML
-		body, err := rb.marshalReqBody(reqBody)
-		if err != nil {
-			result.Err = err
-			return
+	if rb.Offline {
+		if cacheResp != nil {
+			return cacheResp.staleCopy()
 		}
 
+		result.Err = ErrOffline
+		return
+	}
+
+	func(verb string, reqURL string) {
+
 		// Change URL to point to Mockup server
-		reqURL, cacheURL, err = checkMockup(reqURL)
+		reqURL, cacheURL, err = rb.checkMockup(reqURL)
 		if err != nil {
 			result.Err = err
 			return
@@ -66,11 +126,16 @@ func (rb *RequestBuilder) doRequest(verb string, reqURL string, reqBody interfac
 		}
 
 		// Set extra parameters
-		rb.setParams(request, cacheResp, cacheURL)
+		rb.setParams(request, cacheResp, cacheURL, cc)
 
 		// Make the request
 		httpResp, err := client.Do(request)
 		if err != nil {
+			if rb.StaleIfOffline && cacheResp != nil && networkUnavailable(err) {
+				result = cacheResp.staleCopy()
+				return
+			}
+
 			result.Err = err
 			return
 		}
@@ -84,51 +149,78 @@ func (rb *RequestBuilder) doRequest(verb string, reqURL string, reqBody interfac
 		}
 
 		// If we get a 304, return response from cache
-		if httpResp.StatusCode == http.StatusNotModified {
+		if httpResp.StatusCode == http.StatusNotModified && cacheResp != nil {
+			cache.emit(CacheEvent{Type: CacheRevalidate, Key: cacheKey, Size: cacheResp.entrySize, Reason: "not modified"})
 			result = cacheResp
 			return
 		}
 
+		if cacheResp != nil {
+			cache.emit(CacheEvent{Type: CacheRevalidate, Key: cacheKey, Size: cacheResp.entrySize, Reason: "modified"})
+		}
+
 		result.Response = httpResp
 		result.byteBody = respBody
 
-		ttl := setTTL(result)
+		policy := rb.getCachePolicy(cacheURL)
+
+		result.fetchedAt = cache.now()
+		ttl := setTTL(result, result.fetchedAt, policy)
 		lastModified := setLastModified(result)
 		etag := setETag(result)
 
+		// Queries are not revalidated, they need a TTL to be cached
+		if query {
+			lastModified, etag = false, false
+		}
+
 		if !ttl && (lastModified || etag) {
 			result.revalidate = true
 		}
 
-		//If Cache enable: Cache SETNX
-		if !rb.DisableCache && matchVerbs(verb, readVerbs) && (ttl || lastModified || etag) {
-			resourceCache.setNX(cacheURL, result)
+		// no-store is honored, unless a policy says otherwise
+		noStore := hasCacheDirective(result.Header.Get("Cache-Control"), "no-store") &&
+			!policy.ignoreNoCache()
+
+		if rb.DisableCache || !(query || matchVerbs(verb, readVerbs)) {
+			return
+		}
+
+		// Negative Responses never go to the Cache, if there's a NegativeCache.
+		// With no-store, they go to neither
+		if nc := rb.NegativeCache; nc != nil && !noStore && nc.setNX(cacheKey, result) {
+			return
+		}
+
+		//If Cache enable: Cache SETNX, or SET when refreshing or modified
+		if !noStore && (ttl || lastModified || etag) {
+			if refresh || cacheResp != nil {
+				cache.set(cacheKey, result)
+			} else {
+				cache.setNX(cacheKey, result)
+			}
 		}
 		return
-	}(verb, reqURL, reqBody)
+	}(verb, reqURL)
 
 	return
 
 }
 
-func checkMockup(reqURL string) (string, string, error) {
-
-	cacheURL := reqURL
-
-	if mockUpEnv {
-
-		rURL, err := url.Parse(reqURL)
-		if err != nil {
-			return reqURL, cacheURL, err
-		}
+// URL plus the verb and a hash of the marshaled body, as a fragment, so the key
+// is still a valid URL
+func bodyCacheKey(reqURL string, verb string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return reqURL + "#" + verb + ":" + hex.EncodeToString(sum[:])
+}
 
-		rURL.Scheme = mockServerURL.Scheme
-		rURL.Host = mockServerURL.Host
+func (rb *RequestBuilder) checkMockup(reqURL string) (string, string, error) {
 
-		return rURL.String(), cacheURL, nil
+	if ms := rb.mockServer(); ms != nil {
+		return ms.rewrite(reqURL)
 	}
 
-	return reqURL, cacheURL, nil
+	return reqURL, reqURL, nil
 }
 
 func (rb *RequestBuilder) marshalReqBody(body interface{}) (b []byte, err error) {
@@ -167,8 +259,6 @@ func (rb *RequestBuilder) getClient() *http.Client {
 					ResponseHeaderTimeout: rb.getRequestTimeout(),
 				}
 			}
-
-			defaultCheckRedirectFunc = http.Client{}.CheckRedirect
 		})
 
 		tr := defaultTransport
@@ -202,19 +292,30 @@ func (rb *RequestBuilder) getClient() *http.Client {
 			}
 		}
 
-		rb.Client = &http.Client{Transport: tr}
+		// Locked, as Close may read it concurrently
+		rb.lifeMtx.Lock()
+		rb.Client = &http.Client{Transport: tr, CheckRedirect: rb.checkRedirect}
+		rb.lifeMtx.Unlock()
 
 	})
 
+	return rb.Client
+}
+
+// FollowRedirect is checked on every redirect, instead of setting the client
+// CheckRedirect on every request, as the client is shared by concurrent requests.
+func (rb *RequestBuilder) checkRedirect(req *http.Request, via []*http.Request) error {
+
 	if !rb.FollowRedirect {
-		rb.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-			return errors.New("Avoided redirect attempt")
-		}
-	} else {
-		rb.Client.CheckRedirect = defaultCheckRedirectFunc
+		return errors.New("Avoided redirect attempt")
 	}
 
-	return rb.Client
+	// Same policy as the http.Client default
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	return nil
 }
 
 func (rb *RequestBuilder) getRequestTimeout() time.Duration {
@@ -241,7 +342,7 @@ func (rb *RequestBuilder) getConnectionTimeout() time.Duration {
 	}
 }
 
-func (rb *RequestBuilder) setParams(req *http.Request, cacheResp *Response, cacheURL string) {
+func (rb *RequestBuilder) setParams(req *http.Request, cacheResp *Response, cacheURL string, cc *CacheControl) {
 
 	//Custom Headers
 	if rb.Headers != nil {
@@ -254,10 +355,14 @@ func (rb *RequestBuilder) setParams(req *http.Request, cacheResp *Response, cach
 
 	//Default headers
 	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Cache-Control", "no-cache")
+
+	//Cache directives, only if requested
+	if directives := cc.header(); directives != "" {
+		req.Header.Set("Cache-Control", directives)
+	}
 
 	//If mockup
-	if mockUpEnv {
+	if rb.mockServer() != nil {
 		req.Header.Set("X-Original-URL", cacheURL)
 	}
 
@@ -292,7 +397,8 @@ func (rb *RequestBuilder) setParams(req *http.Request, cacheResp *Response, cach
 		}
 	}
 
-	if cacheResp != nil && cacheResp.revalidate {
+	// Revalidation, of Responses that need it, or no-cache requests
+	if cacheResp != nil && (cacheResp.revalidate || cc.noCache()) {
 		switch {
 		case cacheResp.etag != "":
 			req.Header.Set("If-None-Match", cacheResp.etag)
@@ -303,7 +409,7 @@ func (rb *RequestBuilder) setParams(req *http.Request, cacheResp *Response, cach
 
 }
 
-func matchVerbs(s string, sarray [3]string) bool {
+func matchVerbs(s string, sarray []string) bool {
 	for i := 0; i < len(sarray); i++ {
 		if sarray[i] == s {
 			return true
@@ -313,9 +419,51 @@ func matchVerbs(s string, sarray [3]string) bool {
 	return false
 }
 
-func setTTL(resp *Response) (set bool) {
+func setTTL(resp *Response, now time.Time, policy *CachePolicy) (set bool) {
+
+	var ttl time.Duration
+
+	cacheControl := resp.Header.Get("Cache-Control")
+
+	noCache := !policy.ignoreNoCache() &&
+		(hasCacheDirective(cacheControl, "no-cache") || hasCacheDirective(cacheControl, "no-store"))
+
+	// Forced and heuristic TTLs are only for statuses cacheable by default
+	byDefault := cacheableByDefault(resp.StatusCode)
+
+	switch {
+	// Needs to be revalidated every time. Only IgnoreNoCache overrides it
+	case noCache:
+		return
+
+	case policy != nil && policy.ForceTTL > 0 && byDefault:
+		ttl = policy.ForceTTL
+
+	default:
+		var explicit bool
+		ttl, explicit = headersTTL(resp, now)
+
+		if !explicit && byDefault && policy != nil && policy.HeuristicFreshness {
+			ttl = heuristicTTL(resp, now)
+		}
+
+		if ttl <= 0 {
+			return
+		}
+
+		ttl = policy.clamp(ttl)
+	}
+
+	t := now.Add(ttl)
+	resp.ttl = &t
+
+	return true
+}
 
-	now := time.Now()
+// TTL from Cache-Control or Expires headers, and whether there was one.
+// An explicit TTL may be zero or negative, when the server says the Response
+// is already stale. Invalid Expires dates mean that too, as RFC 7234 says.
+func headersTTL(resp *Response, now time.Time) (time.Duration, bool) {
 
 	//Cache-Control Header
 	cacheControl := maxAge.FindStringSubmatch(resp.Header.Get("Cache-Control"))
@@ -324,31 +472,39 @@ func setTTL(resp *Response) (set bool) {
 
 		ttl, err := strconv.Atoi(cacheControl[1])
 		if err != nil {
-			return
+			return 0, true
 		}
 
-		if ttl > 0 {
-			t := now.Add(time.Duration(ttl) * time.Second)
-			resp.ttl = &t
-			set = true
-		}
-
-		return
+		return time.Duration(ttl) * time.Second, true
 	}
 
 	//Expires Header
 	//Date format from RFC-2616, Section 14.21
-	expires, err := time.Parse(httpDateFormat, resp.Header.Get("Expires"))
+	header := resp.Header.Get("Expires")
+	if header == "" {
+		return 0, false
+	}
+
+	expires, err := time.Parse(httpDateFormat, header)
 	if err != nil {
-		return
+		return 0, true
 	}
 
-	if expires.Sub(now) > 0 {
-		resp.ttl = &expires
-		set = true
+	return expires.Sub(now), true
+}
+
+// Statuses cacheable by default, as RFC 7231 section 6.1 and RFC 7538 list
+func cacheableByDefault(status int) bool {
+
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusPartialContent, http.StatusMultipleChoices, http.StatusMovedPermanently,
+		http.StatusPermanentRedirect, http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented:
+		return true
 	}
 
-	return
+	return false
 }
 
 func setLastModified(resp *Response) bool {
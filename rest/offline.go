@@ -0,0 +1,40 @@
+package rest
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrOffline is set as the Response error of requests made by an Offline
+// RequestBuilder, that could not be served from cache
+var ErrOffline = errors.New("RequestBuilder is offline, and the Response is not cached")
+
+// Whether the error means the upstream can't be reached at all, as opposed
+// to an error from the upstream
+func networkUnavailable(err error) bool {
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// A copy of a cached Response, flagged as stale. The cached one is shared,
+// so it is not flagged itself.
+func (r *Response) staleCopy() *Response {
+
+	resp := r.cacheCopy()
+	resp.stale = true
+	resp.cacheHit.Store(true)
+
+	return resp
+}
+
+// Whether a cached Response is past its freshness
+func (r *Response) expired(now time.Time) bool {
+	return r.revalidate || r.ttl == nil || r.ttl.Sub(now) <= 0
+}
@@ -0,0 +1,98 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStaleIfOffline(t *testing.T) {
+
+	upstream := httptest.NewServer(http.HandlerFunc(hotUsers))
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock, KeepStale: time.Hour}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: upstream.URL, Cache: cache, StaleIfOffline: true}
+
+	if r := builder.Get("/hot/user"); r.StatusCode != http.StatusOK || r.Stale() {
+		t.Fatal("Status != OK (200)")
+	}
+
+	upstream.Close()
+	clock.Advance(time.Minute)
+
+	r := builder.Get("/hot/user")
+	if r.Err != nil || !r.Stale() || !r.CacheHit() {
+		t.Fatal("Stale Response should be served when offline")
+	}
+
+	var users []User
+	if err := r.FillUp(&users); err != nil || len(users) != len(userList) {
+		t.Fatal("Stale Response body should be the cached one")
+	}
+
+	builder.StaleIfOffline = false
+	if r := builder.Get("/hot/user"); r.Err == nil {
+		t.Fatal("Network error expected without StaleIfOffline")
+	}
+
+}
+
+func TestOffline(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock, KeepStale: time.Hour}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	builder.Get("/hot/user")
+
+	builder.Offline = true
+	clock.Advance(time.Minute)
+
+	if r := builder.Get("/hot/user"); r.Err != nil || !r.Stale() {
+		t.Fatal("Cached Response should be served, flagged as stale")
+	}
+
+	if r := builder.Get("/user"); r.Err != ErrOffline {
+		t.Fatal("Uncached Response should fail with ErrOffline")
+	}
+
+	if r := builder.Post("/user", &User{Name: "Matilda"}); r.Err != ErrOffline {
+		t.Fatal("Offline requests are not queued")
+	}
+
+}
+
+func TestOfflineExpired(t *testing.T) {
+
+	clock := newFakeClock()
+
+	// Without KeepStale, as the default cache
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache, StaleIfOffline: true}
+	builder.Get("/cache/user")
+
+	builder.Offline = true
+	clock.Advance(time.Minute)
+
+	if r := builder.Get("/cache/user"); r.Err != nil || !r.Stale() || !r.CacheHit() {
+		t.Fatal("Expired Response should be served, flagged as stale")
+	}
+
+	// Once online, the expired Response is not served as fresh
+	builder.Offline = false
+
+	if r := builder.Get("/cache/user"); r.Err != nil || r.Stale() || r.CacheHit() {
+		t.Fatal("Expired Response should be fetched again when online")
+	}
+
+}
@@ -0,0 +1,132 @@
+package rest
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RefreshAhead refreshes hot cached Responses in the background, shortly
+// before they expire. So frequently read resources never expire, and their
+// readers never wait for the upstream.
+//
+// The cached Response keeps being served while it is refreshed, and it is
+// only replaced when the new one is cacheable.
+type RefreshAhead struct {
+
+	// Fraction of the TTL left that triggers a refresh. Zero means 0.1,
+	// that is a refresh within the last 10% of the Response lifetime
+	Window float64
+
+	// Minimum cache hits of a Response to be refreshed. Zero means 2
+	MinHits int
+
+	// Maximum number of refreshes running at the same time. Zero means 2
+	MaxConcurrency int
+
+	initOnce   sync.Once
+	sem        chan struct{}
+	refreshing sync.Map // refreshKey -> struct{}, of the refreshes running
+}
+
+// Refreshes are deduplicated by cache key, as caches like DiskCache return
+// a new Response on every hit
+type refreshKey struct {
+	cache Cache
+	key   string
+}
+
+// This will be executed only once per RefreshAhead
+func (ra *RefreshAhead) init() {
+
+	ra.initOnce.Do(func() {
+
+		maxConcurrency := ra.MaxConcurrency
+		if maxConcurrency <= 0 {
+			maxConcurrency = 2
+		}
+
+		ra.sem = make(chan struct{}, maxConcurrency)
+	})
+
+}
+
+func (ra *RefreshAhead) window() float64 {
+
+	if ra.Window > 0 {
+		return ra.Window
+	}
+
+	return 0.1
+}
+
+func (ra *RefreshAhead) minHits() uint32 {
+
+	if ra.MinHits > 0 {
+		return uint32(ra.MinHits)
+	}
+
+	return 2
+}
+
+// Whether the cached Response is hot, and close enough to expire
+func (ra *RefreshAhead) due(cacheResp *Response, cache Cache) bool {
+
+	if cacheResp.ttl == nil || cacheResp.fetchedAt.IsZero() {
+		return false
+	}
+
+	if atomic.LoadUint32(&cacheResp.hits) < ra.minHits() {
+		return false
+	}
+
+	lifetime := cacheResp.ttl.Sub(cacheResp.fetchedAt)
+	left := cacheResp.ttl.Sub(cache.now())
+
+	return left > 0 && float64(left) <= float64(lifetime)*ra.window()
+}
+
+// Refreshes the cached Response in the background, if it is due.
+// Only one refresh per cache key runs at a time, and if MaxConcurrency
+// refreshes are already running, this one is skipped.
+func (rb *RequestBuilder) refreshAhead(verb string, reqURL string, reqBody interface{}, cacheKey string, cacheResp *Response) {
+
+	ra := rb.RefreshAhead
+	cache := rb.getCache()
+
+	if ra == nil || rb.Offline || !ra.due(cacheResp, cache) {
+		return
+	}
+
+	ra.init()
+
+	key := refreshKey{cache: cache, key: cacheKey}
+
+	if _, running := ra.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	select {
+	case ra.sem <- struct{}{}:
+	default:
+		ra.refreshing.Delete(key)
+		return
+	}
+
+	// Shutdown waits for refreshes too
+	if !rb.acquire() {
+		<-ra.sem
+		ra.refreshing.Delete(key)
+		return
+	}
+
+	go func() {
+
+		defer rb.inFlight.Done()
+
+		rb.send(verb, reqURL, reqBody, nil, true)
+
+		// If the Response was not replaced, it may be refreshed again later
+		ra.refreshing.Delete(key)
+		<-ra.sem
+	}()
+}
@@ -0,0 +1,141 @@
+package rest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshAhead(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
+
+	builder := RequestBuilder{
+		BaseURL:      server.URL,
+		Cache:        cache,
+		RefreshAhead: &RefreshAhead{Window: 0.2, MinHits: 2},
+	}
+
+	hits := atomic.LoadInt64(&hotHits)
+
+	first := builder.Get("/hot/user")
+	if first.StatusCode != 200 {
+		t.Fatal("Status != OK (200)")
+	}
+
+	// Hot, but not close to expire
+	builder.Get("/hot/user")
+	builder.Get("/hot/user")
+
+	if atomic.LoadInt64(&hotHits)-hits != 1 {
+		t.Fatal("Upstream should be hit once")
+	}
+
+	// Within the last 20% of the TTL
+	clock.Advance(9 * time.Second)
+
+	if r := builder.Get("/hot/user"); !r.CacheHit() || r != first {
+		t.Fatal("Cached Response should be served while refreshing")
+	}
+
+	// Waits for the refresh
+	if err := builder.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt64(&hotHits)-hits != 2 {
+		t.Fatal("Upstream should be hit by the refresh")
+	}
+
+	// The original TTL is gone, the refreshed one is not
+	clock.Advance(5 * time.Second)
+
+	r := cache.get(server.URL + "/hot/user")
+	if r == nil || r == first {
+		t.Fatal("Response should have been refreshed")
+	}
+
+}
+
+func TestRefreshAheadMinHits(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
+
+	builder := RequestBuilder{
+		BaseURL:      server.URL,
+		Cache:        cache,
+		RefreshAhead: &RefreshAhead{MinHits: 5},
+	}
+
+	hits := atomic.LoadInt64(&hotHits)
+
+	builder.Get("/hot/user")
+
+	clock.Advance(9500 * time.Millisecond)
+
+	builder.Get("/hot/user")
+	builder.Shutdown(context.Background())
+
+	if atomic.LoadInt64(&hotHits)-hits != 1 {
+		t.Fatal("Cold Response should not be refreshed")
+	}
+
+}
+
+func TestRefreshAheadDiskCache(t *testing.T) {
+
+	var hits int64
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Refreshes wait, so they overlap
+		if atomic.AddInt64(&hits, 1) > 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("hot"))
+	}))
+	defer upstream.Close()
+
+	clock := newFakeClock()
+
+	cache := &DiskCache{Dir: t.TempDir(), Clock: clock}
+	defer cache.Close()
+
+	builder := RequestBuilder{
+		BaseURL:      upstream.URL,
+		Cache:        cache,
+		RefreshAhead: &RefreshAhead{MaxConcurrency: 4},
+	}
+
+	builder.Get("/hot")
+	builder.Get("/hot")
+	builder.Get("/hot")
+
+	clock.Advance(9 * time.Second)
+
+	// Every hit is a new Response
+	for i := 0; i < 5; i++ {
+		builder.Get("/hot")
+	}
+
+	close(release)
+
+	if err := builder.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt64(&hits); n != 2 {
+		t.Fatal("Only one refresh per key should run", n)
+	}
+
+}
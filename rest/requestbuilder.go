@@ -1,6 +1,8 @@
 package rest
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"sync"
 	"time"
@@ -25,6 +27,14 @@ var DefaultConnectTimeout = 1500 * time.Millisecond
 // a CustomPool
 var DefaultMaxIdleConnsPerHost = 2
 
+// ErrBuilderClosed is set as the Response error of any request made after
+// the RequestBuilder was closed or shut down
+var ErrBuilderClosed = errors.New("RequestBuilder is closed")
+
+// MethodQuery is the QUERY HTTP verb. Like GET, it is safe and idempotent,
+// but it carries the query in its body.
+const MethodQuery = "QUERY"
+
 // ContentType represents the Content Type for the Body of HTTP Verbs like
 // POST, PUT, and PATCH
 type ContentType int
@@ -63,6 +73,41 @@ type RequestBuilder struct {
 	// Disable internal caching of Responses
 	DisableCache bool
 
+	// Cache where Responses are stored. Nil means the default cache, shared
+	// by every RequestBuilder
+	Cache Cache
+
+	// Overrides how Responses are cached, for APIs without cache headers
+	CachePolicy *CachePolicy
+
+	// Cache policies by URL path pattern. The first matching one is used
+	// instead of CachePolicy
+	CachePolicies []URLCachePolicy
+
+	// Cache POST and QUERY Responses, keyed by URL plus a hash of the request
+	// body. Only for APIs using POST for queries without side effects.
+	// As there's no revalidation of queries, just Responses with a TTL are cached
+	CachePostQueries bool
+
+	// Caches error Responses, like 404, for a short TTL. Nil means they are
+	// not cached, unless their headers say so
+	NegativeCache *NegativeCache
+
+	// Refreshes hot cached Responses in the background before they expire.
+	// Nil means Responses are fetched again only once expired
+	RefreshAhead *RefreshAhead
+
+	// Never use the network. Cached Responses are served regardless of their
+	// freshness, flagged as Stale. Other requests fail with ErrOffline.
+	// The Cache keeps expired Responses, until evicted by size, from the first
+	// request of an Offline or StaleIfOffline RequestBuilder
+	Offline bool
+
+	// When the network is unavailable (DNS or connection errors), serve cached
+	// Responses regardless of their freshness, flagged as Stale.
+	// The Cache keeps expired Responses from then on, as with Offline
+	StaleIfOffline bool
+
 	// Disable timeout and default timeout = no timeout
 	DisableTimeout bool
 
@@ -82,7 +127,16 @@ type RequestBuilder struct {
 	// Public for custom fine tuning
 	Client *http.Client
 
+	// Send requests to this MockServer. Nil means the global mockup server,
+	// if the mockup environment is on
+	MockServer *MockServer
+
 	clientMtxOnce sync.Once
+
+	// Lifecycle
+	lifeMtx  sync.RWMutex
+	closed   bool
+	inFlight sync.WaitGroup
 }
 
 // CustomPool defines a separate internal *transport* and connection pooling.
@@ -143,6 +197,18 @@ func (rb *RequestBuilder) Patch(url string, body interface{}) *Response {
 	return rb.doRequest(http.MethodPatch, url, nil)
 }
 
+// Query issues a QUERY HTTP verb to the specified URL.
+//
+// QUERY is used for "reading" a resource, when the query is too complex for
+// the URL, so it's sent in the body.
+// Client should expect a response status code of 200(OK), 404(Not Found),
+// or 400(Bad Request).
+//
+// Body could be any of the form: string, []byte, struct & map.
+func (rb *RequestBuilder) Query(url string, body interface{}) *Response {
+	return rb.doRequest(MethodQuery, url, body)
+}
+
 // Delete issues a DELETE HTTP verb to the specified URL
 //
 // In Restful, DELETE is used to "delete" a resource.
@@ -176,7 +242,7 @@ func (rb *RequestBuilder) Options(url string) *Response {
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncGet(url string, f func(*Response)) {
-	go doAsyncRequest(rb.Get(url), f)
+	rb.doAsyncRequest(http.MethodGet, url, nil, f)
 }
 
 // AsyncPost is the *asynchronous* option for POST.
@@ -184,7 +250,7 @@ func (rb *RequestBuilder) AsyncGet(url string, f func(*Response)) {
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncPost(url string, body interface{}, f func(*Response)) {
-	go doAsyncRequest(rb.Post(url, body), f)
+	rb.doAsyncRequest(http.MethodPost, url, body, f)
 }
 
 // AsyncPut is the *asynchronous* option for PUT.
@@ -192,7 +258,7 @@ func (rb *RequestBuilder) AsyncPost(url string, body interface{}, f func(*Respon
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncPut(url string, body interface{}, f func(*Response)) {
-	go doAsyncRequest(rb.Put(url, body), f)
+	rb.doAsyncRequest(http.MethodPut, url, body, f)
 }
 
 // AsyncPatch is the *asynchronous* option for PATCH.
@@ -200,7 +266,15 @@ func (rb *RequestBuilder) AsyncPut(url string, body interface{}, f func(*Respons
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncPatch(url string, body interface{}, f func(*Response)) {
-	go doAsyncRequest(rb.Patch(url, body), f)
+	rb.doAsyncRequest(http.MethodPatch, url, body, f)
+}
+
+// AsyncQuery is the *asynchronous* option for QUERY.
+// The go routine calling AsyncQuery(), will not be blocked.
+//
+// Whenever the Response is ready, the *f* function will be called back.
+func (rb *RequestBuilder) AsyncQuery(url string, body interface{}, f func(*Response)) {
+	rb.doAsyncRequest(MethodQuery, url, body, f)
 }
 
 // AsyncDelete is the *asynchronous* option for DELETE.
@@ -208,7 +282,7 @@ func (rb *RequestBuilder) AsyncPatch(url string, body interface{}, f func(*Respo
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncDelete(url string, f func(*Response)) {
-	go doAsyncRequest(rb.Delete(url), f)
+	rb.doAsyncRequest(http.MethodDelete, url, nil, f)
 }
 
 // AsyncHead is the *asynchronous* option for HEAD.
@@ -216,7 +290,7 @@ func (rb *RequestBuilder) AsyncDelete(url string, f func(*Response)) {
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncHead(url string, f func(*Response)) {
-	go doAsyncRequest(rb.Head(url), f)
+	rb.doAsyncRequest(http.MethodHead, url, nil, f)
 }
 
 // AsyncOptions is the *asynchronous* option for OPTIONS.
@@ -224,11 +298,20 @@ func (rb *RequestBuilder) AsyncHead(url string, f func(*Response)) {
 //
 // Whenever the Response is ready, the *f* function will be called back.
 func (rb *RequestBuilder) AsyncOptions(url string, f func(*Response)) {
-	go doAsyncRequest(rb.Options(url), f)
+	rb.doAsyncRequest(http.MethodOptions, url, nil, f)
 }
 
-func doAsyncRequest(r *Response, f func(*Response)) {
-	f(r)
+func (rb *RequestBuilder) doAsyncRequest(verb string, url string, reqBody interface{}, f func(*Response)) {
+
+	if !rb.acquire() {
+		go f(&Response{Err: ErrBuilderClosed})
+		return
+	}
+
+	go func() {
+		defer rb.inFlight.Done()
+		f(rb.sendRequest(verb, url, reqBody))
+	}()
 }
 
 // ForkJoin let you *fork* requests, and *wait* until all of them have return.
@@ -252,6 +335,11 @@ func (rb *RequestBuilder) ForkJoin(f func(*Concurrent)) {
 
 	c := new(Concurrent)
 	c.reqBuilder = rb
+	c.closed = !rb.acquire()
+
+	if !c.closed {
+		defer rb.inFlight.Done()
+	}
 
 	f(c)
 
@@ -263,3 +351,100 @@ func (rb *RequestBuilder) ForkJoin(f func(*Concurrent)) {
 
 	c.wg.Wait()
 }
+
+// Close closes the idle connections of the RequestBuilder. Any request made
+// after Close gets ErrBuilderClosed.
+//
+// Close does not wait for requests in flight, use Shutdown for that.
+// The Cache of the RequestBuilder is not closed, as it may be shared.
+func (rb *RequestBuilder) Close() error {
+
+	rb.close()
+	rb.closeIdleConnections()
+
+	return nil
+}
+
+// Shutdown gracefully shuts down the RequestBuilder. Any request made after
+// Shutdown gets ErrBuilderClosed, while requests in flight, including Async
+// and ForkJoin ones, are waited for. Then idle connections are closed.
+//
+// If ctx is done before requests in flight have returned, idle connections are
+// closed anyway and the ctx error is returned.
+func (rb *RequestBuilder) Shutdown(ctx context.Context) error {
+
+	rb.close()
+
+	done := make(chan struct{})
+	go func() {
+		rb.inFlight.Wait()
+		close(done)
+	}()
+
+	var err error
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	rb.closeIdleConnections()
+
+	return err
+}
+
+func (rb *RequestBuilder) close() {
+	rb.lifeMtx.Lock()
+	rb.closed = true
+	rb.lifeMtx.Unlock()
+}
+
+// Registers a request in flight. It returns false if the builder is closed.
+// On true, inFlight.Done() must be called when the request is finished.
+func (rb *RequestBuilder) acquire() bool {
+
+	rb.lifeMtx.RLock()
+	defer rb.lifeMtx.RUnlock()
+
+	if rb.closed {
+		return false
+	}
+
+	rb.inFlight.Add(1)
+	return true
+}
+
+func (rb *RequestBuilder) closeIdleConnections() {
+
+	rb.lifeMtx.RLock()
+	client := rb.Client
+	rb.lifeMtx.RUnlock()
+
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
+func (rb *RequestBuilder) getCache() Cache {
+
+	if rb.Cache != nil {
+		return rb.Cache
+	}
+
+	// Isolated from other tests
+	if rb.MockServer != nil {
+		return &rb.MockServer.cache
+	}
+
+	return resourceCache
+}
+
+func (rb *RequestBuilder) mockServer() *MockServer {
+
+	if rb.MockServer != nil {
+		return rb.MockServer
+	}
+
+	return globalMockServer()
+}
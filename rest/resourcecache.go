@@ -3,14 +3,13 @@ package rest
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// ResourceCache, is an LRU-TTL Cache, that caches Responses base on headers
-// It uses 3 goroutines -> one for LRU, and the other two for TTL.
-
-// The cache itself.
-var resourceCache *resourceTtlLruMap
+// The default cache, shared by every RequestBuilder that doesn't set one.
+// As any ResourceCache, its goroutine is started on first use.
+var resourceCache = new(ResourceCache)
 
 // ByteSize is a helper for configuring MaxCacheSize
 type ByteSize int64
@@ -33,209 +32,449 @@ const (
 // Type: rest.ByteSize
 var MaxCacheSize = 1 * GB
 
-// Current Cache Size.
-var cacheSize int64
+// Number of shards. Must be a power of 2
+const cacheShards = 64
 
-type lruOperation int
+type cacheShard struct {
+	sync.Mutex
+	cache   map[string]*Response
+	ttlHeap *ttlHeap   // min-heap for TTL
+	lruList *list.List // List for LRU
+}
 
-const (
-	move lruOperation = iota
-	push
-	del
-	last
-)
+// ResourceCache, is an LRU-TTL Cache, that caches Responses base on headers
+// It is split in shards, each one with its own lock, LRU list and TTL heap,
+// so requests for different keys rarely contend with each other.
+//
+// A ResourceCache is ready to use when declared. Its TTL goroutine is started
+// on first use, and stopped by Close.
+type ResourceCache struct {
+
+	// Maximum Byte Size to be hold by the cache. Zero means MaxCacheSize
+	MaxSize ByteSize
+
+	// Clock used for TTL. Nil means the system clock
+	Clock Clock
+
+	// How long Responses are kept once expired, to be served stale to
+	// requests that allow it. Zero means they are removed when they expire.
+	// Once an Offline or StaleIfOffline RequestBuilder uses the cache, they
+	// are kept until evicted by size
+	KeepStale time.Duration
+
+	// Bodies bigger than this are stored gzipped, and decompressed when read.
+	// Zero means bodies are never compressed
+	CompressAbove ByteSize
+
+	// Called on every cache event. It is called outside the cache locks,
+	// but synchronously, so it should be fast. Nil means no hook
+	OnEvent func(CacheEvent)
+
+	shards    [cacheShards]*cacheShard
+	size      int64     // Current Cache Size. Use atomic
+	evictNext uint32    // Next shard to evict from. Use atomic
+	ttlChan   chan bool // Wakes up the TTL goroutine
+	clock     atomic.Value
+	offline   int32 // Expired Responses are kept. Use atomic
+
+	initOnce  sync.Once
+	closeOnce sync.Once
+	closed    int32         // Use atomic
+	done      chan struct{} // Closed to stop the TTL goroutine
+	stopped   chan struct{} // Closed by the TTL goroutine when it returns
+}
 
-type lruMsg struct {
-	operation lruOperation
-	resp      *Response
+// Wrapper, as atomic.Value needs the same concrete type on every Store
+type clockHolder struct {
+	Clock
 }
 
-type resourceTtlLruMap struct {
-	cache    map[string]*Response
-	skipList *skipList    // skiplist for TTL
-	lruList  *list.List   // List for LRU
-	lruChan  chan *lruMsg // Channel for LRU messages
-	ttlChan  chan bool    // Channel for TTL messages
-	popChan  chan string
-	rwMutex  sync.RWMutex //Read Write Locking Mutex
+// This will be executed only once per cache
+func (rCache *ResourceCache) init() {
+
+	rCache.initOnce.Do(func() {
+
+		rCache.ttlChan = make(chan bool, 1)
+		rCache.done = make(chan struct{})
+		rCache.stopped = make(chan struct{})
+
+		for i := range rCache.shards {
+			rCache.shards[i] = &cacheShard{
+				cache:   make(map[string]*Response),
+				ttlHeap: newTTLHeap(),
+				lruList: list.New(),
+			}
+		}
+
+		clock := rCache.Clock
+		if clock == nil {
+			clock = systemClock{}
+		}
+
+		rCache.clock.Store(clockHolder{clock})
+
+		go rCache.ttl()
+	})
+
 }
 
-func init() {
+// Close stops the cache goroutine, and removes every Response from it.
+// A closed cache stores nothing.
+func (rCache *ResourceCache) Close() error {
+
+	rCache.init()
+
+	rCache.closeOnce.Do(func() {
 
-	resourceCache = &resourceTtlLruMap{
-		cache:    make(map[string]*Response),
-		skipList: newSkipList(),
-		lruList:  list.New(),
-		lruChan:  make(chan *lruMsg, 10000),
-		ttlChan:  make(chan bool, 1000),
-		popChan:  make(chan string),
-		rwMutex:  sync.RWMutex{},
+		atomic.StoreInt32(&rCache.closed, 1)
+
+		close(rCache.done)
+		<-rCache.stopped
+
+		for _, shard := range rCache.shards {
+			shard.Lock()
+			for key, resp := range shard.cache {
+				rCache.remove(shard, key, resp)
+			}
+			shard.Unlock()
+		}
+	})
+
+	return nil
+}
+
+func (rCache *ResourceCache) isClosed() bool {
+	return atomic.LoadInt32(&rCache.closed) == 1
+}
+
+func (rCache *ResourceCache) maxSize() ByteSize {
+
+	if rCache.MaxSize > 0 {
+		return rCache.MaxSize
 	}
 
-	go resourceCache.lruOperations()
-	go resourceCache.ttl()
+	return MaxCacheSize
+}
 
+func (rCache *ResourceCache) getClock() Clock {
+	rCache.init()
+	return rCache.clock.Load().(clockHolder).Clock
 }
 
-func (rCache *resourceTtlLruMap) lruOperations() {
+// Changes the Clock, and wakes up the TTL goroutine so its timer uses the
+// new one.
+func (rCache *ResourceCache) setClock(clock Clock) {
+	rCache.init()
+	rCache.clock.Store(clockHolder{clock})
+	rCache.wakeUpTTL()
+}
 
-	for {
-		msg := <-rCache.lruChan
-
-		switch msg.operation {
-		case move:
-			rCache.lruList.MoveToFront(msg.resp.listElement)
-		case push:
-			msg.resp.listElement = rCache.lruList.PushFront(msg.resp.Request.URL.String())
-		case del:
-			rCache.lruList.Remove(msg.resp.listElement)
-		case last:
-			rCache.popChan <- rCache.lruList.Back().Value.(string)
-		}
+func (rCache *ResourceCache) now() time.Time {
+	return rCache.getClock().Now()
+}
+
+func (rCache *ResourceCache) keepExpired() {
+	atomic.StoreInt32(&rCache.offline, 1)
+}
+
+// Whether a Response with this ttl is no longer kept
+func (rCache *ResourceCache) gone(ttl *time.Time, now time.Time) bool {
+	return ttl != nil && atomic.LoadInt32(&rCache.offline) == 0 && ttl.Add(rCache.KeepStale).Sub(now) <= 0
+}
 
+// FNV-1a, inlined so getting the shard doesn't allocate
+func (rCache *ResourceCache) shard(key string) *cacheShard {
+
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
 	}
 
+	return rCache.shards[hash&(cacheShards-1)]
 }
 
-func (rCache *resourceTtlLruMap) get(key string) *Response {
+func (rCache *ResourceCache) get(key string) *Response {
 
-	//Read lock only
-	rCache.rwMutex.RLock()
-	resp := rCache.cache[key]
-	rCache.rwMutex.RUnlock()
+	rCache.init()
 
-	//If expired, remove it
-	if resp != nil && resp.ttl != nil && resp.ttl.Sub(time.Now()) <= 0 {
+	if rCache.isClosed() {
+		return nil
+	}
 
-		//Full lock
-		rCache.rwMutex.Lock()
-		defer rCache.rwMutex.Unlock()
+	shard := rCache.shard(key)
 
-		//JIC, get the freshest version
-		resp = rCache.cache[key]
+	shard.Lock()
 
-		//Check again with the lock
-		if resp != nil && resp.ttl != nil && resp.ttl.Sub(time.Now()) <= 0 {
-			rCache.remove(key, resp)
-			return nil //return. Do not send the move message
-		}
+	resp := shard.cache[key]
+	if resp == nil {
+		shard.Unlock()
+		rCache.emit(CacheEvent{Type: CacheMiss, Key: key})
+		return nil
+	}
+
+	size := resp.entrySize
 
+	//If expired, and not kept stale, remove it
+	if rCache.gone(resp.ttl, rCache.now()) {
+		rCache.remove(shard, key, resp)
+		shard.Unlock()
+		rCache.emit(CacheEvent{Type: CacheExpire, Key: key, Size: size, Reason: "read"})
+		rCache.emit(CacheEvent{Type: CacheMiss, Key: key})
+		return nil
 	}
 
-	if resp != nil {
+	shard.lruList.MoveToFront(resp.listElement)
+	hits := atomic.AddUint32(&resp.hits, 1)
 
-		//Buffered msg to LruList
-		//Move forward
-		rCache.lruChan <- &lruMsg{
-			operation: move,
-			resp:      resp,
-		}
+	shard.Unlock()
+	rCache.emit(CacheEvent{Type: CacheHit, Key: key, Size: size})
 
+	// Its own copy, so the body is decompressed for this caller only
+	if resp.compressed {
+		resp = resp.cacheCopy()
+		resp.hits = hits
 	}
 
 	return resp
 }
 
 // Set if key not exist
-func (rCache *resourceTtlLruMap) setNX(key string, value *Response) {
+func (rCache *ResourceCache) setNX(key string, value *Response) {
+	rCache.store(key, value, false)
+}
 
-	//Full Lock
-	rCache.rwMutex.Lock()
-	defer rCache.rwMutex.Unlock()
+// Set, replacing the Response if key exists
+func (rCache *ResourceCache) set(key string, value *Response) {
+	rCache.store(key, value, true)
+}
 
-	v := rCache.cache[key]
+func (rCache *ResourceCache) store(key string, value *Response, replace bool) {
 
-	if v == nil {
+	rCache.init()
 
-		rCache.cache[key] = value
+	if rCache.isClosed() {
+		return
+	}
 
-		//PushFront in LruList
-		rCache.lruChan <- &lruMsg{
-			operation: push,
-			resp:      value,
+	// Compressed out of the lock, into a copy only the cache holds, so the
+	// caller's Response doesn't change
+	if rCache.CompressAbove > 0 && !value.compressed && ByteSize(len(value.byteBody)) > rCache.CompressAbove {
+		if compressed := compressBody(value.byteBody); compressed != nil {
+			value = value.cacheCopy()
+			value.byteBody = compressed
+			value.compressed = true
 		}
+	}
+
+	shard := rCache.shard(key)
+
+	shard.Lock()
 
-		//Set ttl if necesary
-		if value.ttl != nil {
-			value.skipListElement = rCache.skipList.insert(key, *value.ttl)
-			rCache.ttlChan <- true
+	var replaced *CacheEvent
+
+	if old := shard.cache[key]; old != nil {
+		if !replace || old == value {
+			shard.Unlock()
+			return
 		}
 
-		// Add Response Size to Cache
-		// Not necessary to use atomic
-		cacheSize += value.size()
+		replaced = &CacheEvent{Type: CacheEvict, Key: key, Size: old.entrySize, Reason: "replaced"}
+		rCache.remove(shard, key, old)
+	}
 
-		for i := 0; ByteSize(cacheSize) >= MaxCacheSize && i < 10; i++ {
+	// The size is calculated once, so the same amount is released on remove.
+	// A Response bigger than the whole cache is never stored.
+	value.entrySize = value.size() + int64(len(key))
+	size := value.entrySize
 
-			rCache.lruChan <- &lruMsg{
-				last,
-				nil,
-			}
+	if ByteSize(size) > rCache.maxSize() {
+		shard.Unlock()
+		if replaced != nil {
+			rCache.emit(*replaced)
+		}
+		rCache.emit(CacheEvent{Type: CacheEvict, Key: key, Size: size, Reason: "too big"})
+		return
+	}
 
-			k := <-rCache.popChan
-			r := rCache.cache[k]
+	shard.cache[key] = value
+	value.listElement = shard.lruList.PushFront(key)
 
-			rCache.remove(k, r)
+	//Set ttl if necesary
+	if value.ttl != nil {
+		value.ttlNode = shard.ttlHeap.insert(key, value.ttl.Add(rCache.KeepStale))
 
+		// Only a new first node may change when the TTL goroutine has to wake up
+		if shard.ttlHeap.first() == value.ttlNode {
+			rCache.wakeUpTTL()
 		}
+	}
+
+	atomic.AddInt64(&rCache.size, size)
 
+	shard.Unlock()
+
+	if replaced != nil {
+		rCache.emit(*replaced)
 	}
+	rCache.emit(CacheEvent{Type: CacheInsert, Key: key, Size: size})
 
+	rCache.evict()
 }
 
-//
-func (rCache *resourceTtlLruMap) remove(key string, resp *Response) {
+// Evict least recently used Responses until we are back under the max size.
+// Shards are visited round robin, locking one at a time.
+func (rCache *ResourceCache) evict() {
+
+	maxSize := rCache.maxSize()
+
+	for empty := 0; empty < cacheShards && ByteSize(atomic.LoadInt64(&rCache.size)) > maxSize; {
+
+		shard := rCache.shards[atomic.AddUint32(&rCache.evictNext, 1)&(cacheShards-1)]
+
+		shard.Lock()
 
-	delete(rCache.cache, key)                    //Delete from map
-	rCache.skipList.remove(resp.skipListElement) //Delete from skipList
-	rCache.lruChan <- &lruMsg{                   //Delete from LruList
-		operation: del,
-		resp:      resp,
+		e := shard.lruList.Back()
+		if e == nil {
+			shard.Unlock()
+			empty++
+			continue
+		}
+
+		key := e.Value.(string)
+		size := shard.cache[key].entrySize
+		rCache.remove(shard, key, shard.cache[key])
+		empty = 0
+
+		shard.Unlock()
+
+		rCache.emit(CacheEvent{Type: CacheEvict, Key: key, Size: size, Reason: "max size"})
 	}
 
+}
+
+// Shard lock must be held
+func (rCache *ResourceCache) remove(shard *cacheShard, key string, resp *Response) {
+
+	delete(shard.cache, key)               //Delete from map
+	shard.ttlHeap.remove(resp.ttlNode)     //Delete from ttlHeap
+	shard.lruList.Remove(resp.listElement) //Delete from LruList
+
 	// Delete bytes cache
-	// Not need for atomic
-	cacheSize -= resp.size()
+	atomic.AddInt64(&rCache.size, -resp.entrySize)
 }
 
-func (rCache *resourceTtlLruMap) ttl() {
+func (rCache *ResourceCache) emit(ev CacheEvent) {
+	if rCache.OnEvent != nil {
+		rCache.OnEvent(ev)
+	}
+}
 
-	// Function to send a message when the timer expires
-	backToFuture := func() {
-		rCache.ttlChan <- true
+// Never blocks. If there's already a pending wake up, that one is enough.
+func (rCache *ResourceCache) wakeUpTTL() {
+	select {
+	case rCache.ttlChan <- true:
+	default:
 	}
+}
+
+func (rCache *ResourceCache) ttl() {
 
-	// A timer.
-	future := time.AfterFunc(24*time.Hour, backToFuture)
+	// A timer. It is created again on every loop, as the clock may change.
+	var future Timer
+
+	defer func() {
+		if future != nil {
+			future.Stop()
+		}
+		close(rCache.stopped)
+	}()
+
+	// Arm the first timer right away
+	rCache.wakeUpTTL()
 
 	for {
 
-		<-rCache.ttlChan
+		select {
+		case <-rCache.ttlChan:
+		case <-rCache.done:
+			return
+		}
 
-		//Full Lock
-		rCache.rwMutex.Lock()
+		clock := rCache.getClock()
 
-		now := time.Now()
+		now := clock.Now()
+		next := now.Add(24 * time.Hour)
 
-		// Traverse the skiplist which is ordered by ttl.
-		// We do this by looping at level 0
-		for node := rCache.skipList.head.next[0]; node != nil; node = node.next[0] {
+		for _, shard := range rCache.shards {
+			if ttl := rCache.expire(shard, now); ttl != nil && ttl.Before(next) {
+				next = *ttl
+			}
+		}
+
+		if future != nil {
+			future.Stop()
+		}
 
-			timeLeft := node.ttl.Sub(now)
+		future = clock.AfterFunc(next.Sub(now), rCache.wakeUpTTL)
+	}
+}
+
+// Max number of Responses expired while holding a shard lock
+const ttlBatchSize = 64
+
+// Removes every expired Response in the shard, in batches, so the lock is
+// released between them and requests are not stalled.
+// Returns the ttl of the next Response to expire, if any.
+func (rCache *ResourceCache) expire(shard *cacheShard, now time.Time) *time.Time {
+
+	// Nothing expires while expired Responses are kept
+	if atomic.LoadInt32(&rCache.offline) == 1 {
+		return nil
+	}
 
-			// If we still have time, check the timer and break
-			if timeLeft > 0 {
-				if !future.Reset(timeLeft) {
-					future = time.AfterFunc(timeLeft, backToFuture)
+	var events []CacheEvent
+
+	for {
+
+		shard.Lock()
+
+		for i := 0; i < ttlBatchSize; i++ {
+
+			node := shard.ttlHeap.first()
+
+			// If we still have time, we are done with this shard
+			if node == nil || node.ttl.Sub(now) > 0 {
+				var next *time.Time
+				if node != nil {
+					ttl := node.ttl
+					next = &ttl
 				}
 
-				break
+				shard.Unlock()
+				rCache.emitAll(events)
+				return next
 			}
 
 			// Remove from cache if time's up
-			rCache.remove(node.key, rCache.cache[node.key])
+			resp := shard.cache[node.key]
+			if rCache.OnEvent != nil {
+				events = append(events, CacheEvent{Type: CacheExpire, Key: node.key, Size: resp.entrySize, Reason: "ttl"})
+			}
+			rCache.remove(shard, node.key, resp)
 		}
 
-		rCache.rwMutex.Unlock()
+		shard.Unlock()
+		events = rCache.emitAll(events)
+	}
+}
+
+// Emits the events, returning the slice emptied to be reused
+func (rCache *ResourceCache) emitAll(events []CacheEvent) []CacheEvent {
+
+	for _, ev := range events {
+		rCache.emit(ev)
 	}
+
+	return events[:0]
 }
@@ -1,8 +1,11 @@
 package rest
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -111,43 +114,295 @@ func TestCacheForkJoinGet(t *testing.T) {
 
 func TestCacheSlowGet(t *testing.T) {
 
-	var f [1000]*Response
+	clock := newFakeClock()
 
-	for i := range f {
-		f[i] = rb.Get("/cache/user")
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
 
-		if f[i].Response.StatusCode != http.StatusOK {
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	var misses int
+
+	for i := 0; i < 1000; i++ {
+
+		resp := builder.Get("/cache/user")
+
+		if resp.Response.StatusCode != http.StatusOK {
 			t.Fatal("f Status != OK (200)")
 		}
 
-		//Wait for so we get cache eviction
-		time.Sleep(3 * time.Millisecond)
+		if !resp.CacheHit() {
+			misses++
+		}
+
+		//Advance so we get cache expiration
+		clock.Advance(3 * time.Millisecond)
+	}
 
+	// 3 seconds, with TTLs of 1 or 2 seconds
+	if misses < 2 || misses > 4 {
+		t.Fatal("Responses should expire once their TTL is over", misses)
 	}
 
 }
 
 func TestCacheSlowForkJoinGet(t *testing.T) {
 
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
 	var f [100]*FutureResponse
+	var missRounds int
 
 	for x := 0; x < 10; x++ {
 
-		rb.ForkJoin(func(cr *Concurrent) {
+		builder.ForkJoin(func(cr *Concurrent) {
 			for i := range f {
 				f[i] = cr.Get("/slow/cache/user")
 			}
 		})
 
+		miss := false
 		for i := range f {
 			if f[i].Response().StatusCode != http.StatusOK {
 				t.Fatal("f[" + strconv.Itoa(i) + "] Status != OK (200)")
 			}
+			miss = miss || !f[i].Response().CacheHit()
+		}
+
+		if miss {
+			missRounds++
+		}
+
+		//Advance so we get cache expiration
+		clock.Advance(300 * time.Millisecond)
+	}
+
+	// 3 seconds, with TTLs of 1 or 2 seconds
+	if missRounds < 2 {
+		t.Fatal("Responses should expire once their TTL is over", missRounds)
+	}
+
+}
+
+func TestCacheStaysWithinMaxCacheSize(t *testing.T) {
+
+	mcs := MaxCacheSize
+	defer func() { MaxCacheSize = mcs }()
+
+	MaxCacheSize = 20 * KB
+
+	for i := 0; i < 200; i++ {
+		resp := rb.Get("/cache/user?size=" + strconv.Itoa(i))
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("Status != OK (200)")
+		}
+
+		size := atomic.LoadInt64(&resourceCache.size)
+
+		if ByteSize(size) > MaxCacheSize {
+			t.Fatal("Cache size " + strconv.FormatInt(size, 10) + " is over MaxCacheSize")
+		}
+	}
+
+}
+
+func TestCacheExpiresWithClock(t *testing.T) {
+
+	clock := newFakeClock()
+
+	resourceCache.setClock(clock)
+	defer resourceCache.setClock(systemClock{})
+
+	resp := rb.Get("/cache/user?clock=1")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Status != OK (200)")
+	}
+
+	if !rb.Get("/cache/user?clock=1").CacheHit() {
+		t.Fatal("Response should be cached")
+	}
+
+	// max-age is at most 2 seconds
+	clock.Advance(3 * time.Second)
+
+	if resourceCache.get(rb.BaseURL+"/cache/user?clock=1") != nil {
+		t.Fatal("Response should have expired")
+	}
+
+}
+
+func TestCacheTTLExpireWithClock(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
+
+	key := "/clock/expire"
+
+	resp := newBenchResponse()
+	ttl := clock.Now().Add(time.Minute)
+	resp.ttl = &ttl
+
+	cache.setNX(key, resp)
+	shard := cache.shard(key)
+
+	if next := cache.expire(shard, clock.Now()); next == nil || !next.Equal(ttl) {
+		t.Fatal("Next expiration should be the Response ttl")
+	}
+
+	clock.Advance(2 * time.Minute)
+	cache.expire(shard, clock.Now())
+
+	shard.Lock()
+	cached := shard.cache[key]
+	shard.Unlock()
+
+	if cached != nil {
+		t.Fatal("Response should have been removed by TTL")
+	}
+
+}
+
+func TestResourceCacheClose(t *testing.T) {
+
+	cache := &ResourceCache{MaxSize: 10 * MB}
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+
+	builder.Get("/cache/user")
+
+	if !builder.Get("/cache/user").CacheHit() {
+		t.Fatal("Response should be cached in the builder cache")
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cache.get(server.URL+"/cache/user") != nil {
+		t.Fatal("A closed cache should be empty")
+	}
+
+	if atomic.LoadInt64(&cache.size) != 0 {
+		t.Fatal("A closed cache should have no size")
+	}
+
+	if builder.Get("/cache/user").CacheHit() {
+		t.Fatal("A closed cache should store nothing")
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatal("Close should be idempotent")
+	}
+
+}
+
+func TestCachePostQueries(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache, CachePostQueries: true}
+
+	builder.Post("/search/user", &User{Name: "Hernan"})
+
+	hernan := builder.Post("/search/user", &User{Name: "Hernan"})
+	if !hernan.CacheHit() {
+		t.Fatal("POST query should be cached")
+	}
+
+	mariana := builder.Post("/search/user", &User{Name: "Mariana"})
+	if mariana.CacheHit() || mariana.String() == hernan.String() {
+		t.Fatal("POST queries should be keyed by body")
+	}
+
+	builder.Query("/search/user", &User{Name: "Hernan"})
+
+	if !builder.Query("/search/user", &User{Name: "Hernan"}).CacheHit() {
+		t.Fatal("QUERY should be cached")
+	}
+
+	noOptIn := RequestBuilder{BaseURL: server.URL, Cache: cache}
+	noOptIn.Post("/search/user", &User{Name: "Axel"})
+
+	if noOptIn.Post("/search/user", &User{Name: "Axel"}).CacheHit() {
+		t.Fatal("POST should not be cached without CachePostQueries")
+	}
+
+}
+
+func TestCacheCompressAbove(t *testing.T) {
+
+	cache := &ResourceCache{CompressAbove: 1 * KB}
+	defer cache.Close()
+
+	many := make([]User, 100)
+	for i := range many {
+		many[i] = User{Id: i, Name: "Hernan"}
+	}
+
+	body, _ := json.Marshal(many)
+
+	newResp := func() *Response {
+		return &Response{
+			Response: &http.Response{Header: http.Header{"Content-Type": {"application/json"}}},
+			byteBody: body,
 		}
+	}
+
+	small := newResp()
+	small.byteBody = body[:512]
+
+	big := newResp()
+
+	cache.setNX("/compress/big", big)
+	cache.setNX("/compress/small", small)
+
+	if big.compressed || !bytes.Equal(big.byteBody, body) {
+		t.Fatal("Stored Response should not change")
+	}
+
+	if cache.get("/compress/small").compressed {
+		t.Fatal("Bodies under CompressAbove should not be compressed")
+	}
+
+	resp := cache.get("/compress/big")
+	if !resp.compressed {
+		t.Fatal("Body should be compressed")
+	}
+
+	if !bytes.Equal(resp.Bytes(), body) || resp.String() != string(body) {
+		t.Fatal("Decompressed body != original body")
+	}
+
+	var users []User
+	if err := resp.FillUp(&users); err != nil || len(users) != 100 {
+		t.Fatal("FillUp of a compressed body failed")
+	}
+
+	if first, second := resp.Bytes(), resp.Bytes(); &first[0] != &second[0] {
+		t.Fatal("Body should be decompressed once")
+	}
+
+	if cache.get("/compress/big") == resp {
+		t.Fatal("Every hit should get its own Response")
+	}
+
+	if atomic.LoadInt64(&cache.size) >= newResp().size()+small.size() {
+		t.Fatal("Size should be the compressed size")
+	}
 
-		//Wait for so we get cache eviction
-		time.Sleep(300 * time.Millisecond)
+	corrupt := &Response{Response: resp.Response, byteBody: []byte("not gzip"), compressed: true}
 
+	if corrupt.Bytes() != nil || corrupt.Err == nil || corrupt.FillUp(&users) == nil {
+		t.Fatal("Decompression error should be reported")
 	}
 
 }
@@ -2,12 +2,14 @@ package rest
 
 import (
 	"container/list"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -16,43 +18,146 @@ import (
 // Response ...
 type Response struct {
 	*http.Response
-	Err             error
-	byteBody        []byte
-	listElement     *list.Element
-	skipListElement *skipListNode
-	ttl             *time.Time
-	lastModified    *time.Time
-	etag            string
-	revalidate      bool
-	cacheHit        atomic.Value
+	Err          error
+	byteBody     []byte
+	compressed   bool // byteBody is gzipped, by the cache
+	listElement  *list.Element
+	ttlNode      *ttlNode
+	ttl          *time.Time
+	lastModified *time.Time
+	etag         string
+	revalidate   bool
+	cacheHit     atomic.Value
+	entrySize    int64
+	fetchedAt    time.Time
+	hits         uint32 // Use atomic
+	stale        bool
+
+	// The compressed body, decompressed on first use
+	decompress    sync.Once
+	decompressed  []byte
+	decompressErr error
 }
 
 func (r *Response) size() int64 {
 
 	size := int64(unsafe.Sizeof(*r))
 
-	size += int64(len(r.byteBody))
-	size += int64(unsafe.Sizeof(*r.listElement))
-	size += int64(unsafe.Sizeof(*r.skipListElement))
-	size += int64(unsafe.Sizeof(*r.ttl))
-	size += int64(unsafe.Sizeof(*r.lastModified))
+	// Body is the biggest part, and ReadAll usually over allocates it
+	size += int64(cap(r.byteBody))
 	size += int64(len(r.etag))
 
+	// Cache structures holding the response
+	size += int64(unsafe.Sizeof(list.Element{}))
+	size += int64(unsafe.Sizeof(ttlNode{}))
+	size += int64(unsafe.Sizeof(&ttlNode{}))
+
+	if r.ttl != nil {
+		size += int64(unsafe.Sizeof(*r.ttl))
+	}
+
+	if r.lastModified != nil {
+		size += int64(unsafe.Sizeof(*r.lastModified))
+	}
+
+	if r.Response == nil {
+		return size
+	}
+
+	size += int64(unsafe.Sizeof(*r.Response))
 	size += int64(len(r.Response.Proto))
 	size += int64(len(r.Response.Status))
-	/*r.Response.Header
-	r.Response.TLS
-	r.Response.Trailer
-	r.Response.TransferEncoding
+	size += headerSize(r.Response.Header)
+	size += headerSize(r.Response.Trailer)
+	size += stringsSize(r.Response.TransferEncoding)
+	size += tlsSize(r.Response.TLS)
+	size += requestSize(r.Response.Request)
 
+	return size
+}
 
-	r.Response.Request.Header
-	r.Response.Request.Host
-	r.Response.Request.Method
-	r.Response.Request.Proto
-	r.Response.Request.RemoteAddr
-	r.Response.Request.RequestURI
-	*/
+// The size of a string slice, counting the slice, string headers and bytes.
+func stringsSize(s []string) int64 {
+
+	size := int64(unsafe.Sizeof(s))
+
+	for _, v := range s {
+		size += int64(unsafe.Sizeof(v)) + int64(len(v))
+	}
+
+	return size
+}
+
+// The size of a header map, counting both keys and values.
+// Every map entry also holds a pointer to a bucket, and a hash.
+func headerSize(h http.Header) int64 {
+
+	if h == nil {
+		return 0
+	}
+
+	size := int64(unsafe.Sizeof(h))
+
+	for k, v := range h {
+		size += int64(unsafe.Sizeof(k)) + int64(len(k)) + 2*int64(unsafe.Sizeof(uintptr(0)))
+		size += stringsSize(v)
+	}
+
+	return size
+}
+
+func requestSize(req *http.Request) int64 {
+
+	if req == nil {
+		return 0
+	}
+
+	size := int64(unsafe.Sizeof(*req))
+	size += int64(len(req.Method))
+	size += int64(len(req.Proto))
+	size += int64(len(req.Host))
+	size += int64(len(req.RemoteAddr))
+	size += int64(len(req.RequestURI))
+	size += headerSize(req.Header)
+	size += headerSize(req.Trailer)
+	size += stringsSize(req.TransferEncoding)
+
+	if req.URL != nil {
+		size += int64(unsafe.Sizeof(*req.URL))
+		size += int64(len(req.URL.Scheme) + len(req.URL.Opaque) + len(req.URL.Host))
+		size += int64(len(req.URL.Path) + len(req.URL.RawPath) + len(req.URL.RawQuery))
+		size += int64(len(req.URL.Fragment))
+	}
+
+	// The request body buffer is kept alive by GetBody
+	if req.GetBody != nil && req.ContentLength > 0 {
+		size += req.ContentLength
+	}
+
+	return size
+}
+
+func tlsSize(state *tls.ConnectionState) int64 {
+
+	if state == nil {
+		return 0
+	}
+
+	size := int64(unsafe.Sizeof(*state))
+	size += int64(len(state.ServerName) + len(state.NegotiatedProtocol))
+	size += int64(len(state.OCSPResponse) + len(state.TLSUnique))
+
+	for _, c := range state.PeerCertificates {
+		size += int64(unsafe.Sizeof(*c)) + int64(len(c.Raw))
+	}
+
+	for _, chain := range state.VerifiedChains {
+		size += int64(len(chain)) * int64(unsafe.Sizeof(state))
+	}
+
+	for _, sct := range state.SignedCertificateTimestamps {
+		size += int64(len(sct))
+	}
 
 	return size
 }
@@ -63,8 +168,29 @@ func (r *Response) String() string {
 }
 
 // Bytes return the Response Body as bytes.
+// If the body was compressed by the cache, it is decompressed on the first
+// call. If that fails, it is nil, and Err says why.
 func (r *Response) Bytes() []byte {
-	return r.byteBody
+	body, _ := r.body()
+	return body
+}
+
+// Every cache hit of a compressed body gets its own Response, so the
+// decompressed body is only kept by the caller.
+func (r *Response) body() ([]byte, error) {
+
+	if !r.compressed {
+		return r.byteBody, nil
+	}
+
+	r.decompress.Do(func() {
+		r.decompressed, r.decompressErr = decompressBody(r.byteBody)
+		if r.decompressErr != nil {
+			r.Err = r.decompressErr
+		}
+	})
+
+	return r.decompressed, r.decompressErr
 }
 
 // FillUp set the *fill* parameter with the corresponding JSON or XML response.
@@ -76,15 +202,20 @@ func (r *Response) FillUp(fill interface{}) error {
 
 	ctype := strings.ToLower(r.Header.Get("Content-Type"))
 
+	body, err := r.body()
+	if err != nil {
+		return err
+	}
+
 	for i := 0; i < 2; i++ {
 
 		switch {
 		case strings.Contains(ctype, ctypeJSON):
-			return json.Unmarshal(r.byteBody, fill)
+			return json.Unmarshal(body, fill)
 		case strings.Contains(ctype, ctypeXML):
-			return xml.Unmarshal(r.byteBody, fill)
+			return xml.Unmarshal(body, fill)
 		case i == 0:
-			ctype = http.DetectContentType(r.byteBody)
+			ctype = http.DetectContentType(body)
 		}
 
 	}
@@ -101,6 +232,12 @@ func (r *Response) CacheHit() bool {
 	return false
 }
 
+// Stale shows if a response was served from the cache after its expiration,
+// because the request allowed it, or the network was not available.
+func (r *Response) Stale() bool {
+	return r.stale
+}
+
 // Debug let any request/response to be dumped, showing how the request/response
 // went through the wire, only if debug mode is *on* on RequestBuilder.
 func (r *Response) Debug() string {
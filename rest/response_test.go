@@ -85,3 +85,24 @@ func TestGetFillUpXML(t *testing.T) {
 
 	t.Fatal("Couldn't found Hernan")
 }
+
+func TestResponseSizeCountsHeaders(t *testing.T) {
+
+	resp := rb.Get("/user")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Status != OK (200)")
+	}
+
+	size := resp.size()
+	if size <= int64(len(resp.Bytes())) {
+		t.Fatal("Response size should be bigger than its body")
+	}
+
+	resp.Header.Set("X-Big-Header", strings.Repeat("a", 1024))
+
+	if resp.size()-size < 1024 {
+		t.Fatal("Response size is not counting headers")
+	}
+
+}
@@ -1,5 +1,10 @@
 package rest
 
+import (
+	"context"
+	"net/http"
+)
+
 var dfltBuilder = RequestBuilder{}
 
 // Get issues a GET HTTP verb to the specified URL.
@@ -52,6 +57,20 @@ func Patch(url string, body interface{}) *Response {
 	return dfltBuilder.Patch(url, body)
 }
 
+// Query issues a QUERY HTTP verb to the specified URL
+//
+// QUERY is used for "reading" a resource, when the query is too complex for
+// the URL, so it's sent in the body.
+// Client should expect a response status code of 200(OK), 404(Not Found),
+// or 400(Bad Request).
+//
+// Body could be any of the form: string, []byte, struct & map.
+//
+// Query uses the DefaultBuilder.
+func Query(url string, body interface{}) *Response {
+	return dfltBuilder.Query(url, body)
+}
+
 // Delete issues a DELETE HTTP verb to the specified URL
 //
 // In Restful, DELETE is used to "delete" a resource.
@@ -126,6 +145,16 @@ func AsyncPatch(url string, body interface{}, f func(*Response)) {
 	dfltBuilder.AsyncPatch(url, body, f)
 }
 
+// AsyncQuery is the *asynchronous* option for QUERY.
+// The go routine calling AsyncQuery(), will not be blocked.
+//
+// Whenever the Response is ready, the *f* function will be called back.
+//
+// AsyncQuery uses the DefaultBuilder
+func AsyncQuery(url string, body interface{}, f func(*Response)) {
+	dfltBuilder.AsyncQuery(url, body, f)
+}
+
 // AsyncDelete is the *asynchronous* option for DELETE.
 // The go routine calling AsyncDelete(), will not be blocked.
 //
@@ -177,3 +206,22 @@ func AsyncOptions(url string, f func(*Response)) {
 func ForkJoin(f func(*Concurrent)) {
 	dfltBuilder.ForkJoin(f)
 }
+
+// Shutdown gracefully shuts down the package: the DefaultBuilder is shut down,
+// waiting for its requests in flight, then the default cache is closed, and
+// idle connections of the default transport too.
+//
+// Every RequestBuilder without a Cache uses the default cache, so after
+// Shutdown none of them caches Responses.
+func Shutdown(ctx context.Context) error {
+
+	err := dfltBuilder.Shutdown(ctx)
+
+	resourceCache.Close()
+
+	if tr, ok := defaultTransport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+
+	return err
+}
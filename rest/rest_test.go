@@ -1,8 +1,10 @@
 package rest
 
 import (
+	"context"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -269,3 +271,73 @@ func TestResponseExceedsRequestTimeout(t *testing.T) {
 		t.Fatalf("Timeouts configuration should get an error after connect")
 	}
 }
+
+func TestShutdownWaitsInFlight(t *testing.T) {
+
+	builder := RequestBuilder{BaseURL: server.URL, CustomPool: &CustomPool{}}
+
+	var done int32
+
+	builder.AsyncGet("/slow/user", func(r *Response) {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := builder.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&done) != 1 {
+		t.Fatal("Shutdown should wait for Async requests")
+	}
+
+	if r := builder.Get("/user"); r.Err != ErrBuilderClosed {
+		t.Fatal("Requests after Shutdown should fail")
+	}
+
+	var f *FutureResponse
+	builder.ForkJoin(func(c *Concurrent) {
+		f = c.Get("/user")
+	})
+
+	if f.Response().Err != ErrBuilderClosed {
+		t.Fatal("ForkJoin after Shutdown should fail")
+	}
+
+}
+
+func TestShutdownTimeout(t *testing.T) {
+
+	builder := RequestBuilder{BaseURL: server.URL, Timeout: time.Second}
+
+	builder.AsyncGet("/slow/user", func(r *Response) {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	if err := builder.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Shutdown should return the context error")
+	}
+
+}
+
+func TestClose(t *testing.T) {
+
+	builder := RequestBuilder{BaseURL: server.URL}
+
+	if r := builder.Get("/user"); r.StatusCode != http.StatusOK {
+		t.Fatal("Status != OK (200)")
+	}
+
+	builder.Close()
+
+	if r := builder.Get("/user"); r.Err != ErrBuilderClosed {
+		t.Fatal("Requests after Close should fail")
+	}
+
+}
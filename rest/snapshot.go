@@ -0,0 +1,96 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Snapshots let you dump the contents of a ResourceCache, and load them back
+// in another process. Useful to pre-warm caches, or to ship golden cache
+// states for reproducible tests.
+//
+// A snapshot is a JSON document. Every entry keeps its URL, status, headers,
+// body, TTL and validators (etag, last modified).
+
+const snapshotVersion = 1
+
+type cacheSnapshot struct {
+	Version int
+	Entries []*cacheEntry
+}
+
+// ExportCache writes a snapshot of the default cache to w.
+func ExportCache(w io.Writer) error {
+	return resourceCache.Export(w)
+}
+
+// ImportCache loads a snapshot written by ExportCache into the default cache.
+func ImportCache(r io.Reader) error {
+	return resourceCache.Import(r)
+}
+
+// Export writes a snapshot of the cache contents to w.
+func (rCache *ResourceCache) Export(w io.Writer) error {
+
+	rCache.init()
+
+	var keys []string
+	var resps []*Response
+
+	for _, shard := range rCache.shards {
+
+		shard.Lock()
+
+		// Least recently used first, so they are imported in the same order
+		for e := shard.lruList.Back(); e != nil; e = e.Prev() {
+			key := e.Value.(string)
+			keys = append(keys, key)
+			resps = append(resps, shard.cache[key])
+		}
+
+		shard.Unlock()
+	}
+
+	// Cached Responses aren't changed once stored, so the entries, which may
+	// need decompressing, are built without holding the locks
+	snapshot := cacheSnapshot{Version: snapshotVersion}
+
+	for i, key := range keys {
+		entry, err := newCacheEntry(key, resps[i])
+		if err != nil {
+			return err
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+
+	return json.NewEncoder(w).Encode(&snapshot)
+}
+
+// Import loads a snapshot written by Export. Entries already expired are
+// skipped, and keys already in the cache are kept as they are.
+func (rCache *ResourceCache) Import(r io.Reader) error {
+
+	var snapshot cacheSnapshot
+
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	if snapshot.Version != snapshotVersion {
+		return errors.New("Unknown cache snapshot version")
+	}
+
+	now := rCache.now()
+
+	for _, entry := range snapshot.Entries {
+
+		if rCache.gone(entry.TTL, now) {
+			continue
+		}
+
+		rCache.setNX(entry.Key, entry.response())
+	}
+
+	return nil
+}
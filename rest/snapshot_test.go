@@ -0,0 +1,113 @@
+package rest
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheExportImport(t *testing.T) {
+
+	cache := &ResourceCache{}
+	defer cache.Close()
+
+	builder := RequestBuilder{BaseURL: server.URL, Cache: cache}
+	resp := builder.Get("/cache/etag/user")
+
+	var b bytes.Buffer
+	if err := cache.Export(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := &ResourceCache{}
+	defer imported.Close()
+
+	if err := imported.Import(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	importedBuilder := RequestBuilder{BaseURL: server.URL, Cache: imported}
+	cached := importedBuilder.Get("/cache/etag/user")
+
+	if !cached.CacheHit() {
+		t.Fatal("Response should be cached after import")
+	}
+
+	if cached.String() != resp.String() || cached.Header.Get("ETag") != "1234" {
+		t.Fatal("Imported Response should be the same as the exported")
+	}
+
+}
+
+func TestCacheImportSkipsExpired(t *testing.T) {
+
+	clock := newFakeClock()
+
+	cache := &ResourceCache{Clock: clock}
+	defer cache.Close()
+
+	resp := newBenchResponse()
+	ttl := clock.Now().Add(time.Minute)
+	resp.ttl = &ttl
+	cache.setNX("/snapshot/expired", resp)
+
+	var b bytes.Buffer
+	if err := cache.Export(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Minute)
+
+	imported := &ResourceCache{Clock: clock}
+	defer imported.Close()
+
+	if err := imported.Import(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if imported.get("/snapshot/expired") != nil {
+		t.Fatal("Expired entries should not be imported")
+	}
+
+}
+
+func TestCacheExportCompressed(t *testing.T) {
+
+	cache := &ResourceCache{CompressAbove: 512}
+	defer cache.Close()
+
+	for i := 0; i < 16; i++ {
+		cache.setNX("/snapshot/compressed/"+strconv.Itoa(i), newBenchResponse())
+	}
+
+	// Entries are decompressed while the cache keeps being used
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cache.get("/snapshot/compressed/" + strconv.Itoa(i%16))
+		}
+	}()
+
+	var b bytes.Buffer
+	if err := cache.Export(&b); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	imported := &ResourceCache{}
+	defer imported.Close()
+
+	if err := imported.Import(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 16; i++ {
+		resp := imported.get("/snapshot/compressed/" + strconv.Itoa(i))
+		if resp == nil || len(resp.Bytes()) != 1024 {
+			t.Fatal("Exported entries should be decompressed")
+		}
+	}
+
+}
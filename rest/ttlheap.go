@@ -0,0 +1,93 @@
+package rest
+
+import (
+	"container/heap"
+	"time"
+)
+
+// ttlHeap is a min-heap of cache keys ordered by ttl. It is the TTL index of
+// every cache shard.
+// The next key to expire is always at the top, so insert and remove are O(lg n),
+// and looking for expired keys is O(1) per expired key. No scans, and no
+// randomness involved, unlike a skiplist.
+
+// A node representation
+type ttlNode struct {
+	ttl   time.Time // we will use this for comparing nodes, and setting order
+	key   string    // important to remove elements from other structures in the cache (lru and map)
+	index int       // position in the heap, needed for removing the node
+}
+
+type ttlHeap []*ttlNode
+
+func newTTLHeap() *ttlHeap {
+	return new(ttlHeap)
+}
+
+// Insert a node to the heap
+func (h *ttlHeap) insert(key string, ttl time.Time) *ttlNode {
+
+	node := &ttlNode{
+		ttl: ttl,
+		key: key,
+	}
+
+	heap.Push(h, node)
+
+	return node
+}
+
+// Remove a node from the heap
+func (h *ttlHeap) remove(node *ttlNode) {
+
+	if node == nil || node.index < 0 {
+		return
+	}
+
+	heap.Remove(h, node.index)
+}
+
+// The node with the lowest ttl, nil if empty
+func (h ttlHeap) first() *ttlNode {
+
+	if len(h) == 0 {
+		return nil
+	}
+
+	return h[0]
+}
+
+// heap.Interface
+
+func (h ttlHeap) Len() int {
+	return len(h)
+}
+
+func (h ttlHeap) Less(i, j int) bool {
+	return h[i].ttl.Before(h[j].ttl)
+}
+
+func (h ttlHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *ttlHeap) Push(x interface{}) {
+	node := x.(*ttlNode)
+	node.index = len(*h)
+	*h = append(*h, node)
+}
+
+func (h *ttlHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+
+	node := old[n-1]
+	old[n-1] = nil
+	node.index = -1
+
+	*h = old[:n-1]
+
+	return node
+}